@@ -7,14 +7,21 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"os"
 	"sync"
 	"time"
 
 	"smtptunnel/internal/config"
 	"smtptunnel/internal/debug"
+	"smtptunnel/internal/dialer"
 	"smtptunnel/internal/forward"
+	"smtptunnel/internal/logging"
+	"smtptunnel/internal/metrics"
+	"smtptunnel/internal/pinning"
 	"smtptunnel/internal/service"
+	"smtptunnel/internal/smtp"
 	"smtptunnel/internal/socks5"
 	"smtptunnel/internal/tunnel"
 )
@@ -69,11 +76,11 @@ Commands:
   check-config     Validate configuration file
   install          Install binary and create directories
   wizard           Interactive configuration generator
-  service          Manage systemd services
+  service          Manage OS services (systemd/launchd/Windows/OpenRC)
   version          Show version
 
 Service subcommands:
-  service install <config.toml>   Register config as systemd service
+  service install <config.toml>   Register config as an OS service
   service list                    List registered services
   service remove <name>           Remove a service
   service logs <name> [-n lines]  View service logs
@@ -83,28 +90,252 @@ Service subcommands:
 `, version)
 }
 
-func buildTLSConfig(cfg *config.Config) *tls.Config {
+// buildTLSConfig builds the client's *tls.Config along with a short
+// description of which verification mode was selected (for debug.Status).
+// Precedence is TLSA pinning, then an MTA-STS-style policy file, then an
+// explicit insecure_skip_verify, then ca_cert; with none of those set it
+// falls back to ordinary PKIX verification against the system root store —
+// never to a silent InsecureSkipVerify.
+func buildTLSConfig(cfg *config.Config) (*tls.Config, string, *pinning.Verifier, error) {
 	tlsCfg := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 	}
 
-	if cfg.Client.InsecureSkipVerify {
+	if cfg.Client.CertFile != "" && cfg.Client.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Client.CertFile, cfg.Client.KeyFile)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("load client cert: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case len(cfg.Client.TLSA) > 0:
+		records := make([]pinning.Record, 0, len(cfg.Client.TLSA))
+		for _, s := range cfg.Client.TLSA {
+			rec, err := pinning.ParseRecord(s)
+			if err != nil {
+				return nil, "", nil, err
+			}
+			records = append(records, rec)
+		}
+		verifier := pinning.NewVerifier(records)
+		// We do our own verification in VerifyPeerCertificate, so Go's
+		// normal PKIX chain check (which DANE bypasses) must be disabled.
 		tlsCfg.InsecureSkipVerify = true
-	} else if cfg.Client.CACert != "" {
-		caCert, err := os.ReadFile(cfg.Client.CACert)
+		tlsCfg.VerifyPeerCertificate = verifier.VerifyPeerCertificate
+		return tlsCfg, fmt.Sprintf("dane (%d TLSA record(s))", len(records)), verifier, nil
+
+	case cfg.Client.MTASTSPolicyFile != "":
+		serverHost := smtp.HostFromAddr(cfg.Client.Server)
+		records, err := pinning.LoadPolicy(cfg.Client.MTASTSPolicyFile, serverHost)
 		if err != nil {
-			// Fall back to insecure if CA cert not found
-			tlsCfg.InsecureSkipVerify = true
-		} else {
-			pool := x509.NewCertPool()
-			pool.AppendCertsFromPEM(caCert)
-			tlsCfg.RootCAs = pool
+			return nil, "", nil, fmt.Errorf("mta_sts_policy_file: %w", err)
 		}
-	} else {
+		verifier := pinning.NewVerifier(records)
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyPeerCertificate = verifier.VerifyPeerCertificate
+		return tlsCfg, fmt.Sprintf("mta-sts (%s, %d record(s))", cfg.Client.MTASTSPolicyFile, len(records)), verifier, nil
+
+	case cfg.Client.InsecureSkipVerify:
 		tlsCfg.InsecureSkipVerify = true
+		return tlsCfg, "insecure (certificate verification disabled)", nil, nil
+
+	case cfg.Client.CACert != "":
+		caCert, err := os.ReadFile(cfg.Client.CACert)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("read ca_cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, "", nil, fmt.Errorf("ca_cert %s contains no usable certificates", cfg.Client.CACert)
+		}
+		tlsCfg.RootCAs = pool
+		return tlsCfg, fmt.Sprintf("ca (%s)", cfg.Client.CACert), nil, nil
+
+	default:
+		return tlsCfg, "system roots", nil, nil
+	}
+}
+
+// listenerSet owns the SOCKS5 and forward listeners for one live tunnel
+// connection, keyed by listen address, so a config.Watcher reload can add
+// or remove listeners in place without reconnecting the tunnel itself.
+type listenerSet struct {
+	client *tunnel.Client
+	logger *log.Logger
+
+	mu    sync.Mutex
+	socks map[string]*socks5.Server
+	fwds  map[string]*forward.Forwarder
+}
+
+func newListenerSet(client *tunnel.Client, logger *log.Logger) *listenerSet {
+	return &listenerSet{
+		client: client,
+		logger: logger,
+		socks:  make(map[string]*socks5.Server),
+		fwds:   make(map[string]*forward.Forwarder),
+	}
+}
+
+// reconcile starts listeners present in cfg but not yet running, and stops
+// ones that are running but no longer in cfg. Listeners whose address is
+// unchanged are left alone, so reconcile is safe to call repeatedly (once
+// at connect time, then again on every hot-reloaded config).
+func (ls *listenerSet) reconcile(cfg *config.Config) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	wantSocks := make(map[string]config.SocksEntry, len(cfg.Client.Socks))
+	for _, s := range cfg.Client.Socks {
+		wantSocks[s.Listen] = s
+	}
+	for addr, srv := range ls.socks {
+		if _, ok := wantSocks[addr]; ok {
+			continue
+		}
+		srv.Close()
+		delete(ls.socks, addr)
+		ls.logger.Printf("SOCKS listener %s removed", addr)
+	}
+	for addr, s := range wantSocks {
+		if _, ok := ls.socks[addr]; ok {
+			continue
+		}
+		srv := &socks5.Server{
+			ListenAddr: s.Listen,
+			Username:   s.Username,
+			Password:   s.Password,
+			Tunnel:     ls.client,
+			Logger:     ls.logger,
+		}
+		ls.socks[addr] = srv
+		go func(srv *socks5.Server) {
+			if err := srv.ListenAndServe(); err != nil {
+				ls.logger.Printf("SOCKS error: %v", err)
+			}
+		}(srv)
+		ls.logger.Printf("SOCKS listener %s added", addr)
 	}
 
-	return tlsCfg
+	wantFwd := make(map[string]config.ForwardEntry, len(cfg.Client.Forward))
+	for _, f := range cfg.Client.Forward {
+		wantFwd[f.Listen] = f
+	}
+	for addr, fwd := range ls.fwds {
+		if _, ok := wantFwd[addr]; ok {
+			continue
+		}
+		fwd.Close()
+		delete(ls.fwds, addr)
+		ls.logger.Printf("Forward listener %s removed", addr)
+	}
+	for addr, f := range wantFwd {
+		if _, ok := ls.fwds[addr]; ok {
+			continue
+		}
+		proto := f.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		username, password := f.Username, f.Password
+		if (proto == "socks5" || proto == "http-connect") && username == "" && password == "" {
+			username, password = cfg.Client.Username, cfg.Client.Secret
+		}
+		fwd := &forward.Forwarder{
+			ListenAddr:     f.Listen,
+			ForwardAddr:    f.Forward,
+			Protocol:       proto,
+			Username:       username,
+			Password:       password,
+			Tunnel:         ls.client,
+			Logger:         ls.logger,
+			UDPIdleTimeout: f.UDPIdleTimeout.Duration,
+		}
+		ls.fwds[addr] = fwd
+		go func(fwd *forward.Forwarder) {
+			if err := fwd.ListenAndServe(); err != nil {
+				ls.logger.Printf("Forward error: %v", err)
+			}
+		}(fwd)
+		ls.logger.Printf("Forward listener %s added", addr)
+	}
+}
+
+// registerReverseForwards asks the server to open a listener for each
+// configured [[client.reverse]] entry. It's called once per connection
+// (not on hot reload - there is no FrameListen equivalent for tearing a
+// registration down, so reverse entries added after connect take effect on
+// the next reconnect). Failures are logged and otherwise non-fatal: other
+// entries, and the tunnel itself, keep working.
+func registerReverseForwards(client *tunnel.Client, cfg *config.Config, logger *log.Logger) {
+	for _, r := range cfg.Client.Reverse {
+		bindHost, bindPortStr, err := net.SplitHostPort(r.RemoteBind)
+		if err != nil {
+			logger.Printf("Reverse: invalid remote_bind %q: %v", r.RemoteBind, err)
+			continue
+		}
+		bindPort, err := net.LookupPort("tcp", bindPortStr)
+		if err != nil {
+			logger.Printf("Reverse: invalid remote_bind port %q: %v", r.RemoteBind, err)
+			continue
+		}
+		dstHost, dstPortStr, err := net.SplitHostPort(r.LocalTarget)
+		if err != nil {
+			logger.Printf("Reverse: invalid local_target %q: %v", r.LocalTarget, err)
+			continue
+		}
+		dstPort, err := net.LookupPort("tcp", dstPortStr)
+		if err != nil {
+			logger.Printf("Reverse: invalid local_target port %q: %v", r.LocalTarget, err)
+			continue
+		}
+
+		boundPort, err := client.OpenReverse(bindHost, uint16(bindPort), dstHost, uint16(dstPort))
+		if err != nil {
+			logger.Printf("Reverse: %s -> %s failed: %v", r.RemoteBind, r.LocalTarget, err)
+			continue
+		}
+		logger.Printf("Reverse: %s:%d -> %s registered", bindHost, boundPort, r.LocalTarget)
+	}
+}
+
+func (ls *listenerSet) closeAll() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for addr, srv := range ls.socks {
+		srv.Close()
+		delete(ls.socks, addr)
+	}
+	for addr, fwd := range ls.fwds {
+		fwd.Close()
+		delete(ls.fwds, addr)
+	}
+}
+
+// buildUpstreamChain builds a dialer.Chain from the configured
+// [client.upstream] hops. With no hops configured it returns nil, meaning
+// dial directly.
+func buildUpstreamChain(cfg *config.Config) (*dialer.Chain, error) {
+	if len(cfg.Client.Upstream.Chain) == 0 {
+		return nil, nil
+	}
+	hops := make([]dialer.Hop, len(cfg.Client.Upstream.Chain))
+	for i, h := range cfg.Client.Upstream.Chain {
+		hops[i] = dialer.Hop{Type: h.Type, Addr: h.Addr, Username: h.Username, Password: h.Password}
+	}
+	return dialer.NewChain(hops)
+}
+
+// jitter returns d randomized by +/-25% so many clients reconnecting after
+// the same outage (e.g. a server restart) don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	spread := float64(d) * 0.25
+	return d + time.Duration(rand.Float64()*2*spread-spread)
 }
 
 func cmdRun() {
@@ -113,20 +344,31 @@ func cmdRun() {
 	debugMode := fs.Bool("debug", false, "Enable debug logging")
 	fs.Parse(os.Args[1:])
 
-	logger := log.New(os.Stdout, "", log.LstdFlags)
-	if *debugMode {
-		logger.SetFlags(log.LstdFlags | log.Lshortfile)
-	}
+	bootLogger := log.New(os.Stdout, "", log.LstdFlags)
 
 	cfg, err := config.Load(*configPath)
 	if err != nil {
-		logger.Fatalf("Load config: %v", err)
+		bootLogger.Fatalf("Load config: %v", err)
 	}
 	if err := cfg.Validate("client"); err != nil {
-		logger.Fatalf("Config error: %v", err)
+		bootLogger.Fatalf("Config error: %v", err)
 	}
 
-	tlsCfg := buildTLSConfig(cfg)
+	logger := logging.New(cfg.Client.Log.Format, *debugMode)
+
+	tlsCfg, pinDesc, _, err := buildTLSConfig(cfg)
+	if err != nil {
+		logger.Fatalf("TLS config: %v", err)
+	}
+	logger.Printf("Certificate verification: %s", pinDesc)
+
+	upstream, err := buildUpstreamChain(cfg)
+	if err != nil {
+		logger.Fatalf("Upstream proxy config: %v", err)
+	}
+	if len(cfg.Client.Upstream.Chain) > 0 {
+		logger.Printf("Dialing via %d upstream hop(s)", len(cfg.Client.Upstream.Chain))
+	}
 
 	reconnectDelay := cfg.Client.ReconnectDelay.Duration
 	maxReconnectDelay := cfg.Client.MaxReconnectDelay.Duration
@@ -140,13 +382,64 @@ func cmdRun() {
 	logger.Printf("SMTP Tunnel Client %s starting", version)
 
 	currentDelay := reconnectDelay
+	first := true
+
+	var clientMu sync.Mutex
+	var liveClient *tunnel.Client
+	var liveListeners *listenerSet
+
+	watcher, err := config.NewWatcher(*configPath, "client")
+	if err != nil {
+		logger.Printf("Config watcher: %v (hot reload disabled)", err)
+	} else {
+		watcher.Subscribe(func(old, next *config.Config, diff config.Diff) {
+			clientMu.Lock()
+			ls := liveListeners
+			clientMu.Unlock()
+			if ls != nil && (diff.SocksChanged || diff.ForwardChanged) {
+				ls.reconcile(next)
+			}
+			logger.Printf("Config reloaded (socks=%v forward=%v stealth=%v)", diff.SocksChanged, diff.ForwardChanged, diff.StealthChanged)
+		})
+		defer watcher.Close()
+	}
+
+	if cfg.Client.Metrics.Listen != "" {
+		logger.Printf("Metrics on %s (/metrics, /healthz)", cfg.Client.Metrics.Listen)
+		go func() {
+			healthy := func() bool {
+				clientMu.Lock()
+				defer clientMu.Unlock()
+				return liveClient != nil && liveClient.Connected()
+			}
+			if err := metrics.Serve(cfg.Client.Metrics.Listen, healthy); err != nil {
+				logger.Printf("Metrics server error: %v", err)
+			}
+		}()
+	}
 
 	for {
-		client := tunnel.NewClient(cfg, tlsCfg, logger)
+		runCfg := cfg
+		if watcher != nil {
+			runCfg = watcher.Current()
+		}
 
-		if err := client.Connect(); err != nil {
-			logger.Printf("Connection failed: %v, retrying in %v...", err, currentDelay)
-			time.Sleep(currentDelay)
+		client := tunnel.NewClient(runCfg, tlsCfg, logger)
+		client.Upstream = upstream
+
+		resume := !first
+		if !first {
+			metrics.Reconnects.Inc()
+		}
+		first = false
+
+		if err := client.ConnectResume(resume); err != nil {
+			if tunnel.IsPermanentError(err) {
+				logger.Fatalf("Connection failed: %v (not retrying - check credentials/certificates)", err)
+			}
+			wait := jitter(currentDelay)
+			logger.Printf("Connection failed: %v, retrying in %v...", err, wait)
+			time.Sleep(wait)
 			currentDelay *= 2
 			if currentDelay > maxReconnectDelay {
 				currentDelay = maxReconnectDelay
@@ -154,6 +447,10 @@ func cmdRun() {
 			continue
 		}
 
+		clientMu.Lock()
+		liveClient = client
+		clientMu.Unlock()
+
 		// Connected - reset delay
 		currentDelay = reconnectDelay
 
@@ -164,68 +461,46 @@ func cmdRun() {
 			close(done)
 		}()
 
-		// Start SOCKS5 servers
-		var socksServers []*socks5.Server
-		var forwarders []*forward.Forwarder
-		var wg sync.WaitGroup
-
-		for _, s := range cfg.Client.Socks {
-			srv := &socks5.Server{
-				ListenAddr: s.Listen,
-				Username:   s.Username,
-				Password:   s.Password,
-				Tunnel:     client,
-				Logger:     logger,
-			}
-			socksServers = append(socksServers, srv)
-
-			wg.Add(1)
-			go func(srv *socks5.Server) {
-				defer wg.Done()
-				if err := srv.ListenAndServe(); err != nil {
-					logger.Printf("SOCKS error: %v", err)
-				}
-			}(srv)
-		}
-
-		// Start forwarders
-		for _, f := range cfg.Client.Forward {
-			proto := f.Protocol
-			if proto == "" {
-				proto = "tcp"
-			}
-			fwd := &forward.Forwarder{
-				ListenAddr:  f.Listen,
-				ForwardAddr: f.Forward,
-				Protocol:    proto,
-				Tunnel:      client,
-				Logger:      logger,
-			}
-			forwarders = append(forwarders, fwd)
-
-			wg.Add(1)
-			go func(fwd *forward.Forwarder) {
-				defer wg.Done()
-				if err := fwd.ListenAndServe(); err != nil {
-					logger.Printf("Forward error: %v", err)
-				}
-			}(fwd)
+		// Detects a half-dead connection (NAT rebinding, wifi handoff, an
+		// upstream mail proxy dropping the socket silently) long before the
+		// next real SendData would time out; returns on its own once
+		// RunReceiver notices the connection is gone.
+		go client.RunKeepAlive()
+
+		// Closes channels left open with no traffic in either direction for
+		// too long (a leaked SOCKS5/forward connection, a peer that stopped
+		// reading); also returns on its own once the connection drops.
+		go client.RunIdleReaper()
+
+		// Rolls session keys once crypto.rekey_bytes/rekey_interval trips (a
+		// no-op, returning immediately, when crypto isn't enabled); also
+		// returns on its own once the connection drops.
+		go client.RunRekey()
+
+		// Start SOCKS5/forward listeners, kept in sync with the config
+		// (including hot reloads) for as long as this tunnel stays up.
+		ls := newListenerSet(client, logger)
+		ls.reconcile(runCfg)
+		clientMu.Lock()
+		liveListeners = ls
+		clientMu.Unlock()
+
+		if len(runCfg.Client.Reverse) > 0 {
+			go registerReverseForwards(client, runCfg, logger)
 		}
 
 		// Wait for connection to drop
 		<-done
 
-		// Close SOCKS servers
-		for _, srv := range socksServers {
-			srv.Close()
-		}
-
-		// Close forwarders
-		for _, fwd := range forwarders {
-			fwd.Close()
-		}
+		clientMu.Lock()
+		liveListeners = nil
+		clientMu.Unlock()
+		ls.closeAll()
 
 		client.Disconnect()
+		clientMu.Lock()
+		liveClient = nil
+		clientMu.Unlock()
 		logger.Printf("Connection lost, reconnecting...")
 	}
 }
@@ -242,9 +517,19 @@ func cmdPing() {
 		os.Exit(1)
 	}
 
-	tlsCfg := buildTLSConfig(cfg)
+	tlsCfg, _, _, err := buildTLSConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "TLS config: %v\n", err)
+		os.Exit(1)
+	}
+
+	upstream, err := buildUpstreamChain(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Upstream proxy config: %v\n", err)
+		os.Exit(1)
+	}
 
-	results, err := debug.Ping(cfg, tlsCfg, *count)
+	results, err := debug.Ping(cfg, tlsCfg, upstream, *count)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Ping failed: %v\n", err)
 		os.Exit(1)
@@ -264,8 +549,18 @@ func cmdStatus() {
 		os.Exit(1)
 	}
 
-	tlsCfg := buildTLSConfig(cfg)
-	fmt.Print(debug.Status(cfg, tlsCfg))
+	tlsCfg, pinDesc, verifier, err := buildTLSConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "TLS config: %v\n", err)
+		os.Exit(1)
+	}
+
+	upstream, err := buildUpstreamChain(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Upstream proxy config: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(debug.Status(cfg, tlsCfg, pinDesc, verifier, upstream))
 }
 
 func cmdCheckConfig() {
@@ -2,15 +2,21 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"smtptunnel/internal/certs"
+	"smtptunnel/internal/certs/acme"
 	"smtptunnel/internal/config"
 	"smtptunnel/internal/debug"
+	"smtptunnel/internal/pki"
 	"smtptunnel/internal/service"
 	"smtptunnel/internal/tunnel"
 	"smtptunnel/internal/users"
@@ -38,6 +44,10 @@ func main() {
 		cmdListUsers()
 	case "gencerts":
 		cmdGenCerts()
+	case "issue-ca":
+		cmdIssueCA()
+	case "issue-cert":
+		cmdIssueCert()
 	case "check-config":
 		cmdCheckConfig()
 	case "install":
@@ -46,6 +56,8 @@ func main() {
 		cmdWizard()
 	case "service":
 		cmdService()
+	case "htpasswd":
+		cmdHtpasswd()
 	case "version":
 		fmt.Printf("smtptunnel-server %s\n", version)
 	case "help", "--help", "-h":
@@ -69,14 +81,22 @@ Commands:
   deluser          Remove a user from the config
   listusers        List all configured users
   gencerts         Generate TLS certificates
+  issue-ca         Generate a CA for mTLS client certificates
+  issue-cert       Issue an mTLS client certificate for a user
   check-config     Validate configuration file
   install          Install binary and create directories
   wizard           Interactive configuration generator
-  service          Manage systemd services
+  service          Manage OS services (systemd/launchd/Windows/OpenRC)
+  htpasswd         Manage an htpasswd-backed user store
   version          Show version
 
+Htpasswd subcommands:
+  htpasswd add <username> -file <path> -password <pw>     Add/update a user
+  htpasswd passwd <username> -file <path> -password <pw>  Change a password
+  htpasswd del <username> -file <path>                     Remove a user
+
 Service subcommands:
-  service install <config.toml>   Register config as systemd service
+  service install <config.toml>   Register config as an OS service
   service list                    List registered services
   service remove <name>           Remove a service
   service logs <name> [-n lines]  View service logs
@@ -105,39 +125,111 @@ func cmdRun() {
 		logger.Fatalf("Config error: %v", err)
 	}
 
-	// Load TLS
-	cert, err := tls.LoadX509KeyPair(cfg.Server.CertFile, cfg.Server.KeyFile)
-	if err != nil {
-		logger.Fatalf("Load TLS: %v", err)
+	// Load TLS, preferring ACME-issued certificates over the self-signed
+	// pair when [server.acme] is enabled.
+	var tlsCfg *tls.Config
+	if cfg.Server.Acme.Enabled {
+		mgr, err := acme.New(acme.Options{
+			Hostname:    cfg.Server.Hostname,
+			Email:       cfg.Server.Acme.Email,
+			CacheDir:    filepath.Join(filepath.Dir(cfg.Server.CertFile), "acme-cache"),
+			Challenge:   cfg.Server.Acme.Challenge,
+			DNSProvider: cfg.Server.Acme.DNSProvider,
+			Staging:     cfg.Server.Acme.Staging,
+		})
+		if err != nil {
+			logger.Fatalf("ACME: %v", err)
+		}
+		tlsCfg = mgr.TLSConfig()
+		if cfg.Server.Acme.Challenge == "" || cfg.Server.Acme.Challenge == "http-01" {
+			go func() {
+				if err := mgr.ListenChallengeServer(context.Background()); err != nil {
+					logger.Printf("ACME challenge server: %v", err)
+				}
+			}()
+		}
+	} else {
+		cert, err := tls.LoadX509KeyPair(cfg.Server.CertFile, cfg.Server.KeyFile)
+		if err != nil {
+			logger.Fatalf("Load TLS: %v", err)
+		}
+		tlsCfg = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
 	}
 
-	tlsCfg := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+	if cfg.Server.ClientCAFile != "" {
+		pool, err := loadClientCAPool(cfg.Server.ClientCAFile)
+		if err != nil {
+			logger.Fatalf("Load client CA: %v", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = clientAuthType(cfg.Server.ClientAuth)
 	}
 
 	srv := tunnel.NewServer(cfg, tlsCfg, logger)
+
+	watcher, err := config.NewWatcher(*configPath, "server")
+	if err != nil {
+		logger.Printf("Config watcher: %v (hot reload disabled)", err)
+	} else {
+		watcher.Subscribe(func(old, next *config.Config, diff config.Diff) {
+			srv.ApplyConfig(next)
+			logger.Printf("Config reloaded (users=%v stealth=%v)", diff.UsersChanged, diff.StealthChanged)
+		})
+		defer watcher.Close()
+	}
+
 	logger.Printf("SMTP Tunnel Server %s starting", version)
 	if err := srv.ListenAndServe(); err != nil {
 		logger.Fatalf("Server error: %v", err)
 	}
 }
 
+// loadClientCAPool reads one or more PEM-encoded CA certificates used to
+// verify mTLS client certificates.
+func loadClientCAPool(file string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// clientAuthType maps config.ServerConfig.ClientAuth to its tls.ClientAuthType.
+func clientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.NoClientCert
+	}
+}
+
 func cmdAddUser() {
 	fs := flag.NewFlagSet("adduser", flag.ExitOnError)
 	configPath := fs.String("c", "config.toml", "Config file path")
 	secret := fs.String("secret", "", "Secret (auto-generated if empty)")
 	noLogging := fs.Bool("no-logging", false, "Disable logging for this user")
+	allowReverse := fs.Bool("allow-reverse", false, "Allow this user to register reverse port forwards")
+	reversePrivileged := fs.Bool("reverse-privileged-ports", false, "Allow this user's reverse forwards to bind ports below 1024 (requires -allow-reverse)")
 	fs.Parse(os.Args[1:])
 
 	if fs.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: smtptunnel-server adduser <username> [-c config.toml] [--secret <s>]")
+		fmt.Fprintln(os.Stderr, "Usage: smtptunnel-server adduser <username> [-c config.toml] [--secret <s>] [-allow-reverse] [-reverse-privileged-ports]")
 		os.Exit(1)
 	}
 	username := fs.Arg(0)
 
 	logging := !*noLogging
-	if err := users.AddUser(*configPath, username, *secret, nil, logging); err != nil {
+	if err := users.AddUser(*configPath, username, *secret, nil, logging, *allowReverse, *reversePrivileged); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
@@ -205,6 +297,80 @@ func cmdGenCerts() {
 	fmt.Printf("Files written to: %s\n", *outputDir)
 }
 
+func cmdIssueCA() {
+	fs := flag.NewFlagSet("issue-ca", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "/etc/smtptunnel/certs/clients", "Output directory for the CA")
+	days := fs.Int("days", 3650, "CA validity in days")
+	keySize := fs.Int("key-size", 2048, "RSA key size")
+	fs.Parse(os.Args[1:])
+
+	fmt.Println("Generating mTLS client certificate CA...")
+	if _, err := pki.GenerateCA(pki.CAOptions{
+		OutputDir: *outputDir,
+		Days:      *days,
+		KeySize:   *keySize,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("CA written to %s/ca.crt and %s/ca.key\n", *outputDir, *outputDir)
+	fmt.Printf("Set server.client_ca_file = %q and server.client_auth = \"require\" (or \"verify-if-given\").\n", filepath.Join(*outputDir, "ca.crt"))
+}
+
+func cmdIssueCert() {
+	fs := flag.NewFlagSet("issue-cert", flag.ExitOnError)
+	configPath := fs.String("c", "config.toml", "Config file path")
+	caDir := fs.String("ca-dir", "/etc/smtptunnel/certs/clients", "Directory containing ca.crt/ca.key")
+	days := fs.Int("days", 365, "Certificate validity in days")
+	keySize := fs.Int("key-size", 2048, "RSA key size")
+	// flag parsing stops at the first non-flag argument, so take a leading
+	// <username> off before parsing the flags that follow it.
+	args := os.Args[1:]
+	var username string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		username, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if username == "" && fs.NArg() > 0 {
+		username = fs.Arg(0)
+	}
+
+	if username == "" {
+		fmt.Fprintln(os.Stderr, "Usage: smtptunnel-server issue-cert <username> [-c config.toml] [-ca-dir <dir>]")
+		os.Exit(1)
+	}
+
+	ca, err := pki.LoadCA(filepath.Join(*caDir, "ca.crt"), filepath.Join(*caDir, "ca.key"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading CA (run issue-ca first?): %v\n", err)
+		os.Exit(1)
+	}
+
+	certPEM, keyPEM, fingerprint, err := pki.IssueClientCert(ca, pki.ClientCertOptions{
+		Username: username,
+		Days:     *days,
+		KeySize:  *keySize,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := pki.WriteClientCert(*caDir, username, certPEM, keyPEM); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing cert: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := users.SetClientCertFingerprint(*configPath, username, fingerprint); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: issued cert but failed to record fingerprint in %s: %v\n", *configPath, err)
+	} else {
+		fmt.Printf("Fingerprint recorded for user %q in %s\n", username, *configPath)
+	}
+
+	fmt.Printf("Client certificate written to %s/%s.crt and %s/%s.key\n", *caDir, username, *caDir, username)
+}
+
 func cmdCheckConfig() {
 	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
 	configPath := fs.String("c", "config.toml", "Config file path")
@@ -238,6 +404,68 @@ func cmdWizard() {
 	}
 }
 
+func cmdHtpasswd() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: smtptunnel-server htpasswd <add|passwd|del> <username> -file <path> [-password <pw>]")
+		os.Exit(1)
+	}
+
+	subcmd := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	fs := flag.NewFlagSet("htpasswd", flag.ExitOnError)
+	file := fs.String("file", "", "Path to the htpasswd file")
+	password := fs.String("password", "", "Password for add/passwd")
+	// As in cmdIssueCert, take the leading <username> off first so the
+	// flags after it are parsed.
+	args := os.Args[1:]
+	var username string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		username, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if username == "" && fs.NArg() > 0 {
+		username = fs.Arg(0)
+	}
+
+	if username == "" {
+		fmt.Fprintln(os.Stderr, "Usage: smtptunnel-server htpasswd <add|passwd|del> <username> -file <path>")
+		os.Exit(1)
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "Error: -file is required")
+		os.Exit(1)
+	}
+
+	switch subcmd {
+	case "add", "passwd":
+		if *password == "" {
+			fmt.Fprintln(os.Stderr, "Error: -password is required")
+			os.Exit(1)
+		}
+		var err error
+		if subcmd == "add" {
+			err = users.HtpasswdAdd(*file, username, *password)
+		} else {
+			err = users.HtpasswdSetPassword(*file, username, *password)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("User '%s' written to %s\n", username, *file)
+	case "del":
+		if err := users.HtpasswdDel(*file, username); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("User '%s' removed from %s\n", username, *file)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown htpasswd command: %s\n", subcmd)
+		os.Exit(1)
+	}
+}
+
 func cmdService() {
 	if len(os.Args) < 2 {
 		fmt.Fprintln(os.Stderr, "Usage: smtptunnel-server service <install|list|remove|logs|stop|restart> [args]")
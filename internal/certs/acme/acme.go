@@ -0,0 +1,103 @@
+// Package acme provisions TLS certificates automatically via ACME (e.g.
+// Let's Encrypt), as an alternative to certs.Generate's self-signed pair.
+// A real, browser-trusted cert makes the SMTP disguise indistinguishable
+// from a genuine mail server to passive TLS fingerprinters, at the cost
+// of needing a reachable hostname and a completed ACME challenge.
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Options configures automatic certificate provisioning.
+type Options struct {
+	Hostname string
+	Email    string
+	CacheDir string
+
+	// Challenge selects the ACME challenge type: "http-01" (default) or
+	// "dns-01". HTTP-01 needs a reachable :80 listener (see
+	// Manager.ListenChallengeServer); DNS-01 avoids that at the cost of a
+	// provider integration.
+	Challenge string
+	// DNSProvider names the DNS-01 provider to use (e.g. "cloudflare",
+	// "route53"). Only consulted when Challenge is "dns-01".
+	DNSProvider string
+	// Staging directs requests at Let's Encrypt's staging directory, for
+	// testing without burning production rate limits.
+	Staging bool
+}
+
+// Manager wraps an autocert.Manager to provide hot-rotating certificates
+// via tls.Config.GetCertificate.
+type Manager struct {
+	opts Options
+	mgr  *autocert.Manager
+}
+
+// New creates a Manager for opts. Only Challenge == "http-01" is
+// currently implemented; "dns-01" is rejected with an explicit error
+// rather than silently behaving like http-01, since DNS-01 needs a
+// provider-specific TXT record solver this package doesn't have yet.
+func New(opts Options) (*Manager, error) {
+	if opts.Hostname == "" {
+		return nil, fmt.Errorf("acme: hostname is required")
+	}
+	if opts.CacheDir == "" {
+		return nil, fmt.Errorf("acme: cache dir is required")
+	}
+
+	switch opts.Challenge {
+	case "", "http-01":
+		// supported below
+	case "dns-01":
+		return nil, fmt.Errorf("acme: dns-01 challenge (provider %q) is not yet implemented; use http-01", opts.DNSProvider)
+	default:
+		return nil, fmt.Errorf("acme: unknown challenge type %q", opts.Challenge)
+	}
+
+	client := &acme.Client{}
+	if opts.Staging {
+		client.DirectoryURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	}
+
+	mgr := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(opts.Hostname),
+		Cache:      autocert.DirCache(opts.CacheDir),
+		Email:      opts.Email,
+		Client:     client,
+	}
+
+	return &Manager{opts: opts, mgr: mgr}, nil
+}
+
+// TLSConfig returns a *tls.Config whose GetCertificate hot-rotates
+// certificates as autocert renews them, so the server never needs a
+// restart to pick up a renewed cert.
+func (m *Manager) TLSConfig() *tls.Config {
+	cfg := m.mgr.TLSConfig()
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg
+}
+
+// ListenChallengeServer serves the HTTP-01 challenge on :80 and blocks
+// until ctx is cancelled or the listener fails. Callers should run it in
+// its own goroutine alongside the tunnel listener.
+func (m *Manager) ListenChallengeServer(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    ":80",
+		Handler: m.mgr.HTTPHandler(nil),
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	return srv.ListenAndServe()
+}
@@ -14,6 +14,7 @@ type Config struct {
 	Server  ServerConfig  `toml:"server"`
 	Client  ClientConfig  `toml:"client"`
 	Stealth StealthConfig `toml:"stealth"`
+	Crypto  CryptoConfig  `toml:"crypto"`
 }
 
 // ServerConfig holds server-side settings.
@@ -25,6 +26,80 @@ type ServerConfig struct {
 	LogLevel string      `toml:"log_level"`
 	TLS      TLSConfig   `toml:"tls"`
 	Users    []UserEntry `toml:"users"`
+
+	// UsersFile, if set, authenticates against an external htpasswd-style
+	// file instead of (or in addition to falling back from) the inline
+	// Users list. See internal/users.FileAuthenticator. Validate still
+	// requires at least one inline [[server.users]] entry either way.
+	UsersFile string `toml:"users_file"`
+	// SidecarFile holds per-user whitelist/logging settings keyed by
+	// username, for deployments where Users live in UsersFile and so have
+	// nowhere else to carry those settings.
+	SidecarFile string `toml:"sidecar_file"`
+
+	// Acme, if enabled, provisions a real certificate via ACME (e.g. Let's
+	// Encrypt) instead of CertFile/KeyFile. See internal/certs/acme.
+	Acme AcmeConfig `toml:"acme"`
+
+	// ClientCAFile, if set, enables mutual TLS: client certificates are
+	// verified against the CA certificate(s) in this file, and a verified
+	// peer certificate can authenticate a session on its own through AUTH
+	// EXTERNAL (see users.FingerprintAuthenticator), with no secret sent.
+	// See internal/pki.
+	ClientCAFile string `toml:"client_ca_file"`
+	// ClientAuth is "none" (default), "verify-if-given" (verify a client
+	// certificate if the client offers one, but don't require one), or
+	// "require" (reject the TLS handshake unless the client presents a
+	// certificate signed by ClientCAFile). Ignored unless ClientCAFile is
+	// set.
+	ClientAuth string `toml:"client_auth"`
+	// CertsDir is where `smtptunnel-server issue-cert` writes newly issued
+	// client certificate/key pairs. See internal/pki.
+	CertsDir string `toml:"certs_dir"`
+
+	// Audit controls the structured per-connection audit trail emitted
+	// alongside the normal log. See internal/logging.Auditor.
+	Audit AuditConfig `toml:"audit"`
+
+	// ChannelIdleTimeout closes a tunnel channel (via FrameClose) once it has
+	// carried no FrameData in either direction for this long, so a leaked or
+	// forgotten channel doesn't hold server-side resources forever. Defaults
+	// to 5 minutes if zero.
+	ChannelIdleTimeout Duration `toml:"channel_idle_timeout"`
+}
+
+// AuditConfig controls internal/logging.Auditor's structured JSON audit
+// trail - one event per auth attempt, channel connect/disconnect, and
+// service install/remove - meant for ingestion by a downstream SIEM rather
+// than human reading.
+type AuditConfig struct {
+	Enabled bool `toml:"enabled"`
+
+	// Path, if set, writes audit events to this file, rotated via
+	// lumberjack instead of going to stdout.
+	Path       string `toml:"path"`
+	MaxSizeMB  int    `toml:"max_size_mb"`
+	MaxAgeDays int    `toml:"max_age_days"`
+	MaxBackups int    `toml:"max_backups"`
+
+	// RedactTargets replaces each CONNECT's destination hostname with a
+	// truncated hash (keeping the port) in audit events, so the trail can
+	// confirm connection counts and timing without recording exactly which
+	// hosts a user visited.
+	RedactTargets bool `toml:"redact_targets"`
+}
+
+// AcmeConfig controls automatic certificate provisioning via ACME.
+type AcmeConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Email   string `toml:"email"`
+	// Challenge is "http-01" (default) or "dns-01".
+	Challenge string `toml:"challenge"`
+	// DNSProvider names the DNS-01 provider; only used when Challenge is
+	// "dns-01".
+	DNSProvider string `toml:"dns_provider"`
+	// Staging targets Let's Encrypt's staging directory for testing.
+	Staging bool `toml:"staging"`
 }
 
 // TLSConfig holds TLS-specific settings.
@@ -38,18 +113,172 @@ type UserEntry struct {
 	Secret    string   `toml:"secret"`
 	Whitelist []string `toml:"whitelist"`
 	Logging   bool     `toml:"logging"`
+
+	// ClientCertFingerprint, if set, is the lowercase hex SHA-256
+	// fingerprint of this user's mTLS client certificate (as issued by
+	// internal/pki). A session presenting a certificate matching this
+	// fingerprint authenticates as Username via AUTH EXTERNAL, with no secret.
+	// Requires server.client_ca_file to be set.
+	ClientCertFingerprint string `toml:"client_cert_fingerprint"`
+
+	// AllowReverse permits this user to register reverse port-forward
+	// listeners on the server via FrameListen. Defaults to false: a client
+	// otherwise unable to bind a listener on the server host can't turn the
+	// tunnel around to expose an internal service unless explicitly allowed.
+	AllowReverse bool `toml:"allow_reverse"`
+	// ReversePrivilegedPorts additionally permits AllowReverse users to bind
+	// ports below 1024. Ignored if AllowReverse is false.
+	ReversePrivilegedPorts bool `toml:"reverse_privileged_ports"`
+
+	// MaxChannels caps this user's concurrent tunnel channels. Zero means
+	// unlimited. A CONNECT/CONNECT_UDP over the cap is rejected with
+	// FrameConnectFail(ConnectFailChannelLimit).
+	MaxChannels int `toml:"max_channels"`
+	// MaxConnectRate caps how many channels this user may open per minute.
+	// Zero means unlimited. A CONNECT/CONNECT_UDP over the cap is rejected
+	// with FrameConnectFail(ConnectFailQuotaExceeded).
+	MaxConnectRate int `toml:"max_connect_rate"`
+	// MaxBytesPerMinute caps this user's aggregate channel traffic (both
+	// directions, summed across all channels) per minute. Zero means
+	// unlimited. Traffic over the cap is throttled (the channel's own relay
+	// goroutine blocks until the next window) rather than dropped, since
+	// channels carry reliable streams that can't tolerate data loss.
+	MaxBytesPerMinute int64 `toml:"max_bytes_per_minute"`
 }
 
 // ClientConfig holds client-side settings.
 type ClientConfig struct {
-	Server             string        `toml:"server"`
-	Username           string        `toml:"username"`
-	Secret             string        `toml:"secret"`
-	CACert             string        `toml:"ca_cert"`
-	InsecureSkipVerify bool          `toml:"insecure_skip_verify"`
-	ReconnectDelay     Duration      `toml:"reconnect_delay"`
-	MaxReconnectDelay  Duration      `toml:"max_reconnect_delay"`
-	Socks              []SocksEntry  `toml:"socks"`
+	Server             string `toml:"server"`
+	Username           string `toml:"username"`
+	Secret             string `toml:"secret"`
+	CACert             string `toml:"ca_cert"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+
+	// CertFile and KeyFile, if both set, present this client certificate
+	// during the TLS handshake so a server with server.client_ca_file
+	// configured can authenticate the session via mTLS instead of (or in
+	// addition to) the AUTH exchange. See internal/pki.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// TLSA pins the server certificate DANE-style, as one or more
+	// "<usage> <selector> <matching-type> <hex-digest>" records (e.g.
+	// "3 1 1 <sha256 of the leaf SPKI>"). When set, it takes precedence over
+	// CACert/InsecureSkipVerify and the normal PKIX chain is not checked at
+	// all. See internal/pinning.
+	TLSA []string `toml:"tlsa"`
+	// MTASTSPolicyFile, if set (and TLSA is not), pins the server against an
+	// MTA-STS-style policy file on disk listing allowed hostnames and their
+	// TLSA-style records, enforced with a maximum age. See
+	// internal/pinning.LoadPolicy.
+	MTASTSPolicyFile  string         `toml:"mta_sts_policy_file"`
+	ReconnectDelay    Duration       `toml:"reconnect_delay"`
+	MaxReconnectDelay Duration       `toml:"max_reconnect_delay"`
+	Socks             []SocksEntry   `toml:"socks"`
+	Forward           []ForwardEntry `toml:"forward"`
+	Reverse           []ReverseEntry `toml:"reverse"`
+
+	// KeepAliveInterval is how often Client.RunKeepAlive sends a PING while
+	// connected, to notice a half-dead socket (NAT rebinding, wifi handoff,
+	// an upstream mail proxy dropping the connection silently) long before
+	// the next real SendData would time out. Defaults to 30s if zero.
+	KeepAliveInterval Duration `toml:"keepalive_interval"`
+	// KeepAliveMaxRTT is the RTT above which a PONG counts as late rather
+	// than on time. Defaults to 10s if zero.
+	KeepAliveMaxRTT Duration `toml:"keepalive_max_rtt"`
+	// KeepAliveMaxMissed is how many consecutive late-or-missing PONGs
+	// Client.RunKeepAlive tolerates before closing the connection to force
+	// a reconnect. Defaults to 3 if zero.
+	KeepAliveMaxMissed int `toml:"keepalive_max_missed"`
+
+	// ChannelIdleTimeout closes a tunnel channel locally (and notifies the
+	// server with FrameClose) once it has carried no FrameData in either
+	// direction for this long. Defaults to 5 minutes if zero.
+	ChannelIdleTimeout Duration `toml:"channel_idle_timeout"`
+
+	// AuthMode selects how AUTH is performed: "hmac" (default) signs the
+	// shared secret so it's never sent over the wire, and requires the
+	// server to hold the raw secret; "password" sends the secret directly
+	// (safe post-STARTTLS) so the server can verify it against a one-way
+	// hash, as required for UsersFile/htpasswd-backed auth; "scram" runs a
+	// real SCRAM-SHA-256 exchange with channel binding, which also requires
+	// the server to hold the raw secret (see internal/users.ScramAuthenticator);
+	// "external" sends no secret at all and authenticates purely by the mTLS
+	// client certificate configured via CertFile/KeyFile, requiring the
+	// server to have ClientCAFile/ClientAuth configured (see internal/pki).
+	AuthMode string `toml:"auth_mode"`
+
+	// Upstream routes the outbound tunnel connection through one or more
+	// chained proxies instead of dialing the server directly. See
+	// internal/dialer.
+	Upstream UpstreamConfig `toml:"upstream"`
+
+	// Log controls the client's log output. See internal/logging.
+	Log LogConfig `toml:"log"`
+	// Metrics, if Listen is set, exposes Prometheus metrics and a health
+	// check over HTTP. See internal/metrics.
+	Metrics MetricsConfig `toml:"metrics"`
+}
+
+// LogConfig controls the client's log output.
+type LogConfig struct {
+	// Format is "text" (default) or "json".
+	Format string `toml:"format"`
+}
+
+// MetricsConfig controls the client's Prometheus metrics endpoint.
+type MetricsConfig struct {
+	// Listen, if set, starts an HTTP server serving /metrics and /healthz
+	// on this address (e.g. ":9101"). Left blank, no metrics server runs.
+	Listen string `toml:"listen"`
+}
+
+// UpstreamConfig chains one or more proxies in front of the outbound tunnel
+// connection, each hop tunneled inside the previous one.
+type UpstreamConfig struct {
+	Chain []UpstreamHop `toml:"chain"`
+}
+
+// UpstreamHop is a single proxy in an UpstreamConfig.Chain.
+type UpstreamHop struct {
+	// Type is "socks5", "http-connect", or "tor" (SOCKS5 with a default Tor
+	// SOCKS addr of 127.0.0.1:9050 when Addr is left blank).
+	Type     string `toml:"type"`
+	Addr     string `toml:"addr"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// ForwardEntry defines a single port-forward listener. Protocol is "tcp"
+// (default) or "udp" for a fixed Forward destination, or "socks5" /
+// "http-connect" for a dynamic proxy frontend where the destination comes
+// from each request instead of Forward.
+type ForwardEntry struct {
+	Listen   string `toml:"listen"`
+	Forward  string `toml:"forward"`
+	Protocol string `toml:"protocol"`
+
+	// Username/Password gate access when Protocol is "socks5" or
+	// "http-connect". Left blank, they default to the client's own
+	// Username/Secret, so the same credential that authenticates the
+	// tunnel also unlocks the local proxy.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	// UDPIdleTimeout overrides how long a UDP NAT session may sit idle
+	// before it's reaped, for Protocol == "udp". Zero uses forward.Forwarder's
+	// default.
+	UDPIdleTimeout Duration `toml:"udp_idle_timeout"`
+}
+
+// ReverseEntry defines a single reverse port-forward: a listener the server
+// opens on its own host (RemoteBind), with every inbound connection
+// tunneled back through the session to LocalTarget on the client's side.
+// The server user must have UserEntry.AllowReverse (or the equivalent
+// users.SidecarUser field) set, or the registration is rejected.
+type ReverseEntry struct {
+	RemoteBind  string `toml:"remote_bind"`
+	LocalTarget string `toml:"local_target"`
 }
 
 // SocksEntry defines a single SOCKS5 listener.
@@ -61,11 +290,83 @@ type SocksEntry struct {
 
 // StealthConfig controls DPI evasion features.
 type StealthConfig struct {
+	// Enabled turns on stealth.TLSRecordConn, which reshapes the
+	// post-handshake tunnel stream into well-formed TLS records (each
+	// padded to one of PaddingSizes, occasionally interleaved with a dummy
+	// ChangeCipherSpec keepalive record) instead of the raw binary
+	// protocol, so a passive observer sees a record stream shaped like
+	// ordinary TLS traffic. DummyProbability is the chance each write is
+	// followed by a keepalive record; MinDelayMs/MaxDelayMs are handed to
+	// stealth.Shaper, but TLSRecordConn applies no delay from them. See
+	// internal/stealth.Shaper and .TLSRecordConn.
+	// Independent of (and composable with) Shaping below.
 	Enabled          bool    `toml:"enabled"`
 	MinDelayMs       int     `toml:"min_delay_ms"`
 	MaxDelayMs       int     `toml:"max_delay_ms"`
 	PaddingSizes     []int   `toml:"padding_sizes"`
 	DummyProbability float64 `toml:"dummy_probability"`
+
+	// Profile selects which real-world MTA's banner, EHLO capability list,
+	// and response text smtp.ServerHandshake impersonates. One of
+	// "postfix-ubuntu" (default), "postfix-debian", "exim", "sendmail", or
+	// "exchange-o365". See internal/smtp.LookupProfile.
+	Profile string `toml:"profile"`
+
+	// Shaping reshapes the binary tunnel stream itself (after the SMTP
+	// handshake) into message-sized, randomly-timed chunks so a passive
+	// observer sees traffic resembling a real mail transaction rather than
+	// one continuous binary stream. See internal/stealth.ShapedConn.
+	Shaping ShapingConfig `toml:"shaping"`
+}
+
+// ShapingConfig controls internal/stealth.ShapedConn's per-flow shaping of
+// the post-handshake tunnel stream.
+type ShapingConfig struct {
+	Enabled bool `toml:"enabled"`
+
+	// MeanSize/StddevSize describe a log-normal distribution (in bytes)
+	// outbound writes are chunked to. Defaults are calibrated to typical
+	// mail sizes (roughly 2-50KB).
+	MeanSize   int `toml:"mean_size"`
+	StddevSize int `toml:"stddev_size"`
+
+	// MinDelayMs/MaxDelayMs bound a uniform inter-chunk delay.
+	MinDelayMs int `toml:"min_delay_ms"`
+	MaxDelayMs int `toml:"max_delay_ms"`
+
+	// FrameAsData wraps each chunk in a synthetic DATA/./250 sequence so
+	// the wire shows SMTP-shaped lines at chunk boundaries.
+	FrameAsData bool `toml:"frame_as_data"`
+}
+
+// CryptoConfig controls internal/crypto.TunnelCrypto's forward-secret
+// session key exchange, layered on top of the TLS connection: once Enabled,
+// tunnel.Client and tunnel.Server run Handshake right after the TLS/SMTP
+// handshake and encrypt/decrypt every FrameData payload under the derived
+// keys. On the server, this only takes effect for a user with a plaintext
+// secret the server can fold into the exchange (an inline [[server.users]]
+// entry); a UsersFile/htpasswd-backed or sidecar user's session still runs
+// TLS-only, since the server never sees their secret in plaintext.
+type CryptoConfig struct {
+	// Enabled turns on the post-handshake key exchange. Left false, the
+	// tunnel relies on TLS alone, as before.
+	Enabled bool `toml:"enabled"`
+
+	// KEM is "x25519" (default) or "x25519+kyber768", which adds a
+	// Kyber768 encapsulation so session keys also resist a future
+	// quantum-capable attacker. See crypto.KEMX25519Kyber768.
+	KEM string `toml:"kem"`
+
+	// RekeyBytes triggers crypto.TunnelCrypto.Rekey once this many bytes
+	// have been sent under the current session keys. Zero disables the
+	// byte-count trigger. Both tunnel.Client and tunnel.Server/serverSession
+	// check ShouldRekey on a timer and coordinate the actual re-handshake
+	// over a FrameRekeyReq/FrameRekeyMsg exchange (see tunnel/rekey.go), so
+	// either peer tripping its own trigger rolls keys on both sides.
+	RekeyBytes uint64 `toml:"rekey_bytes"`
+	// RekeyInterval triggers Rekey once this much time has passed since
+	// the last key exchange. Zero disables the time trigger.
+	RekeyInterval Duration `toml:"rekey_interval"`
 }
 
 // Duration wraps time.Duration for TOML string parsing.
@@ -105,6 +406,19 @@ func Load(path string) (*Config, error) {
 	cfg.Stealth.PaddingSizes = []int{4096, 8192, 16384, 32768}
 	cfg.Stealth.DummyProbability = 0.1
 
+	cfg.Stealth.Shaping.MeanSize = 16000
+	cfg.Stealth.Shaping.StddevSize = 9000
+	cfg.Stealth.Shaping.MinDelayMs = 20
+	cfg.Stealth.Shaping.MaxDelayMs = 250
+
+	cfg.Crypto.KEM = "x25519"
+	cfg.Crypto.RekeyBytes = 1 << 30 // 1 GiB
+	cfg.Crypto.RekeyInterval = Duration{30 * time.Minute}
+
+	cfg.Server.Audit.MaxSizeMB = 100
+	cfg.Server.Audit.MaxAgeDays = 30
+	cfg.Server.Audit.MaxBackups = 7
+
 	if err := toml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
@@ -126,15 +440,33 @@ func (c *Config) Validate(mode string) error {
 		if c.Server.Listen == "" {
 			return fmt.Errorf("server.listen is required")
 		}
-		if c.Server.CertFile == "" {
-			return fmt.Errorf("server.cert_file is required")
-		}
-		if c.Server.KeyFile == "" {
-			return fmt.Errorf("server.key_file is required")
+		if !c.Server.Acme.Enabled {
+			if c.Server.CertFile == "" {
+				return fmt.Errorf("server.cert_file is required")
+			}
+			if c.Server.KeyFile == "" {
+				return fmt.Errorf("server.key_file is required")
+			}
 		}
 		if len(c.Server.Users) == 0 {
 			return fmt.Errorf("at least one [[server.users]] entry is required")
 		}
+		switch c.Server.ClientAuth {
+		case "", "none", "verify-if-given", "require":
+		default:
+			return fmt.Errorf("server.client_auth must be \"none\", \"verify-if-given\", or \"require\"")
+		}
+		if c.Server.ClientAuth != "" && c.Server.ClientAuth != "none" && c.Server.ClientCAFile == "" {
+			return fmt.Errorf("server.client_auth %q requires server.client_ca_file", c.Server.ClientAuth)
+		}
+		if c.Server.ClientCAFile != "" && (c.Server.ClientAuth == "" || c.Server.ClientAuth == "none") {
+			return fmt.Errorf("server.client_ca_file is set but server.client_auth is \"none\"")
+		}
+		for _, u := range c.Server.Users {
+			if u.ClientCertFingerprint != "" && c.Server.ClientCAFile == "" {
+				return fmt.Errorf("user %q has client_cert_fingerprint but server.client_ca_file is not set", u.Username)
+			}
+		}
 	case "client":
 		if c.Client.Server == "" {
 			return fmt.Errorf("client.server is required")
@@ -145,10 +477,18 @@ func (c *Config) Validate(mode string) error {
 		if c.Client.Secret == "" {
 			return fmt.Errorf("client.secret is required")
 		}
-		if len(c.Client.Socks) == 0 {
-			return fmt.Errorf("at least one [[client.socks]] entry is required")
+		if len(c.Client.Socks) == 0 && len(c.Client.Forward) == 0 && len(c.Client.Reverse) == 0 {
+			return fmt.Errorf("at least one [[client.socks]], [[client.forward]], or [[client.reverse]] entry is required")
+		}
+		if (c.Client.CertFile == "") != (c.Client.KeyFile == "") {
+			return fmt.Errorf("client.cert_file and client.key_file must both be set, or both left blank")
 		}
 	}
+	switch c.Crypto.KEM {
+	case "", "x25519", "x25519+kyber768":
+	default:
+		return fmt.Errorf("crypto.kem must be \"x25519\" or \"x25519+kyber768\"")
+	}
 	return nil
 }
 
@@ -183,6 +523,47 @@ min_version = "1.2"
 # secret = "auto-generated-secret"
 # whitelist = ["0.0.0.0/0"]
 # logging = true
+# allow_reverse = false
+# reverse_privileged_ports = false
+# max_channels = 0           # 0 = unlimited
+# max_connect_rate = 0       # channels/minute, 0 = unlimited
+# max_bytes_per_minute = 0   # 0 = unlimited
+
+# Or authenticate against an htpasswd-style file instead:
+# users_file = "/etc/smtptunnel/users.htpasswd"
+# sidecar_file = "/etc/smtptunnel/users.toml"
+
+# Or provision a real certificate via ACME instead of cert_file/key_file:
+# [server.acme]
+# enabled = true
+# email = "admin@example.com"
+# challenge = "http-01"
+# dns_provider = ""
+# staging = false
+
+# Require mutual TLS: client certificates are checked against this CA, and
+# a verified certificate authenticates the session on its own if the user's
+# client_cert_fingerprint matches. Issue a CA and per-user client certs
+# with: smtptunnel-server issue-ca and smtptunnel-server issue-cert <name>.
+# client_ca_file = "ca.crt"
+# client_auth = "require"  # or "verify-if-given"
+# certs_dir = "/etc/smtptunnel/certs/clients"
+# [[server.users]]
+# username = "alice"
+# client_cert_fingerprint = "0000000000000000000000000000000000000000000000000000000000000000"
+
+# Structured per-connection audit trail (auth outcomes, channel
+# connect/disconnect, service install/remove), separate from the normal
+# log, for ingestion by a downstream SIEM:
+# [server.audit]
+# enabled = true
+# path = "/var/log/smtptunnel/audit.log"
+# max_size_mb = 100
+# max_age_days = 30
+# max_backups = 7
+# redact_targets = false
+
+# channel_idle_timeout = "5m"
 
 [client]
 server = "mail.example.com:587"
@@ -190,20 +571,102 @@ username = ""
 secret = ""
 ca_cert = "ca.crt"
 insecure_skip_verify = false
+
+# Present a client certificate for mTLS, issued by
+# smtptunnel-server issue-cert <name>:
+# cert_file = "alice.crt"
+# key_file = "alice.key"
+
 reconnect_delay = "2s"
 max_reconnect_delay = "30s"
 
+# keepalive_interval = "30s"
+# keepalive_max_rtt = "10s"
+# keepalive_max_missed = 3
+
+# channel_idle_timeout = "5m"
+
+# DANE-style pinning instead of ca_cert (bypasses PKIX chain validation):
+# tlsa = ["3 1 1 0000000000000000000000000000000000000000000000000000000000000000"]
+
+# Route the outbound connection through one or more chained proxies
+# (e.g. to reach the server over Tor, or from a network that only
+# permits egress via a mandated HTTP proxy). Each hop is tunneled
+# inside the previous one.
+# [client.upstream]
+# chain = [
+#   { type = "tor" },
+#   { type = "http-connect", addr = "proxy.corp.example:8080", username = "", password = "" },
+# ]
+
+# Structured logging and Prometheus metrics:
+# [client.log]
+# format = "json"  # or "text" (default)
+#
+# [client.metrics]
+# listen = ":9101"  # exposes /metrics and /healthz
+
+# Or MTA-STS-style: pin against a policy file refreshed out of band.
+# mta_sts_policy_file = "/etc/smtptunnel/mta-sts-policy.json"
+
 [[client.socks]]
 listen = "127.0.0.1:1080"
 username = ""
 password = ""
 
+# Fixed port forward:
+# [[client.forward]]
+# listen = "127.0.0.1:8022"
+# forward = "internal-host:22"
+# protocol = "tcp"
+
+# UDP forward (e.g. DNS, QUIC, WireGuard):
+# [[client.forward]]
+# listen = "127.0.0.1:5353"
+# forward = "internal-dns:53"
+# protocol = "udp"
+# udp_idle_timeout = "60s"
+
+# Dynamic SOCKS5/HTTP CONNECT frontend (forward is ignored; destination
+# comes from each request). Username/password default to client.username
+# and client.secret above when left blank.
+# [[client.forward]]
+# listen = "127.0.0.1:1081"
+# protocol = "socks5"
+
+# Reverse port forward: ask the server to open remote_bind on its own host
+# and tunnel every connection it accepts back to local_target here. Requires
+# the server user to have allow_reverse = true (see [[server.users]] above).
+# [[client.reverse]]
+# remote_bind = "0.0.0.0:8080"
+# local_target = "127.0.0.1:3000"
+
 [stealth]
 enabled = true
 min_delay_ms = 50
 max_delay_ms = 500
 padding_sizes = [4096, 8192, 16384, 32768]
 dummy_probability = 0.1
+# profile = "postfix-ubuntu"  # or "postfix-debian", "exim", "sendmail", "exchange-o365"
+
+# Reshape the post-handshake binary stream into message-sized, randomly
+# timed chunks so it resembles a real mail transaction on the wire:
+# [stealth.shaping]
+# enabled = true
+# mean_size = 16000
+# stddev_size = 9000
+# min_delay_ms = 20
+# max_delay_ms = 250
+# frame_as_data = true
+
+# Layer a forward-secret, ephemeral key exchange on top of TLS: a future
+# leak of client.secret/server.users.secret can't decrypt traffic from
+# before this was enabled. Requires both ends to run matching code.
+# [crypto]
+# enabled = true
+# kem = "x25519"  # or "x25519+kyber768" for post-quantum resistance
+# rekey_bytes = 1073741824  # roll session keys every 1 GiB
+# rekey_interval = "30m"
 `
 	return os.WriteFile(path, []byte(content), 0644)
 }
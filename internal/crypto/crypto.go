@@ -2,49 +2,268 @@
 package crypto
 
 import (
+	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
 
+// KEM selects the key-exchange algorithm TunnelCrypto.Handshake runs to
+// derive session keys. KEMX25519Kyber768 adds a Kyber768 encapsulation
+// alongside the X25519 exchange so a future large-scale quantum computer
+// capable of breaking X25519 still can't recover session keys, since it
+// would also need to break Kyber768.
+const (
+	KEMX25519         = "x25519"
+	KEMX25519Kyber768 = "x25519+kyber768"
+)
+
+// Overhead is how many bytes Encrypt adds to plaintext (a 12-byte nonce
+// prefix plus the AEAD's 16-byte tag). Callers that chunk plaintext to fit
+// a fixed-size frame (see proto.MaxPayloadSize) must reserve this much
+// headroom per chunk.
+const Overhead = chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+
 // TunnelCrypto handles encryption, decryption, and auth tokens.
+//
+// Encrypt/Decrypt are gated behind Handshake: TunnelCrypto no longer derives
+// usable session keys from secret alone, since a single leak of a static
+// secret would then compromise every session, past and future, that used
+// it. Handshake instead runs an ephemeral key exchange over the
+// already-authenticated tunnel connection and folds secret in only as the
+// HKDF salt, so session keys have forward secrecy even if secret later
+// leaks. Rekey re-runs the same exchange on a live tunnel to bound how much
+// traffic any single set of session keys ever protects.
 type TunnelCrypto struct {
 	secret   []byte
-	sendKey  []byte
-	recvKey  []byte
-	sendSeq  uint64
-	recvSeq  uint64
+	kem      string
 	isServer bool
+
+	mu      sync.RWMutex
+	ready   bool
+	sendKey []byte
+	recvKey []byte
+	epoch   uint32
+
+	sendSeq uint64
+	recvSeq uint64
+
+	sendBytes     uint64
+	rekeyBytes    uint64
+	rekeyInterval time.Duration
+	lastRekey     time.Time
 }
 
-// NewTunnelCrypto creates a new crypto instance.
-// isServer determines key direction (client→server vs server→client).
-func NewTunnelCrypto(secret string, isServer bool) (*TunnelCrypto, error) {
-	tc := &TunnelCrypto{
-		secret:   []byte(secret),
-		isServer: isServer,
+// NewTunnelCrypto creates a new crypto instance. isServer determines key
+// direction (client→server vs server→client) once Handshake derives keys;
+// Encrypt and Decrypt return an error until Handshake has run. kem is
+// KEMX25519 or KEMX25519Kyber768; an empty string defaults to KEMX25519.
+// rekeyBytes and rekeyInterval configure ShouldRekey and are zero-value
+// safe (zero disables that trigger).
+func NewTunnelCrypto(secret string, isServer bool, kem string, rekeyBytes uint64, rekeyInterval time.Duration) (*TunnelCrypto, error) {
+	switch kem {
+	case "":
+		kem = KEMX25519
+	case KEMX25519, KEMX25519Kyber768:
+	default:
+		return nil, fmt.Errorf("unknown kem %q", kem)
 	}
-	if err := tc.deriveKeys(); err != nil {
+
+	return &TunnelCrypto{
+		secret:        []byte(secret),
+		kem:           kem,
+		isServer:      isServer,
+		rekeyBytes:    rekeyBytes,
+		rekeyInterval: rekeyInterval,
+	}, nil
+}
+
+// writeHandshakeMsg writes one length-prefixed message of the Handshake
+// exchange. Kyber768 public keys (1184 bytes) and ciphertexts (1088 bytes)
+// both fit comfortably under the uint16 length limit.
+func writeHandshakeMsg(w io.Writer, b []byte) error {
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readHandshakeMsg(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
 	}
-	return tc, nil
+	return b, nil
+}
+
+// Handshake runs an ephemeral key exchange over rw (the raw tunnel
+// connection, after TLS but before any framed traffic) and installs fresh
+// session keys derived from it. Call it once before the first Encrypt or
+// Decrypt; call it again (as Rekey) to roll keys on an already-open tunnel.
+func (tc *TunnelCrypto) Handshake(rw io.ReadWriter) error {
+	return tc.exchange(rw)
+}
+
+// Rekey re-runs the key exchange over rw and installs a new epoch of
+// session keys, bounding how much traffic any one set of keys protects.
+// Both peers must call Rekey at essentially the same time: until the peer
+// does, frames it sends under the old keys will fail to decrypt here, and
+// vice versa. Callers typically have ShouldRekey trigger one side, which
+// then signals the other out of band (e.g. a dedicated control frame)
+// before both call Rekey.
+func (tc *TunnelCrypto) Rekey(rw io.ReadWriter) error {
+	return tc.exchange(rw)
+}
+
+// ShouldRekey reports whether enough bytes have been sent, or enough time
+// has passed since the last handshake, to warrant calling Rekey.
+func (tc *TunnelCrypto) ShouldRekey() bool {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	if !tc.ready {
+		return false
+	}
+	if tc.rekeyBytes > 0 && atomic.LoadUint64(&tc.sendBytes) >= tc.rekeyBytes {
+		return true
+	}
+	if tc.rekeyInterval > 0 && time.Since(tc.lastRekey) >= tc.rekeyInterval {
+		return true
+	}
+	return false
+}
+
+// exchange performs the ephemeral X25519 (and, for KEMX25519Kyber768,
+// Kyber768) key exchange over rw and derives the next epoch's session
+// keys from it. The Kyber768 leg forces a fixed message order: the server
+// must publish its Kyber768 public key before the client can encapsulate
+// against it, so the server always writes its message first regardless of
+// which side calls Handshake/Rekey first; the client reads before it
+// writes.
+func (tc *TunnelCrypto) exchange(rw io.ReadWriter) error {
+	curve := ecdh.X25519()
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate ephemeral key: %w", err)
+	}
+	localX25519 := priv.PublicKey().Bytes()
+
+	var kyberPriv kyber768.PrivateKey
+	useKyber := tc.kem == KEMX25519Kyber768
+
+	var peerX25519 []byte
+	var kemShared []byte
+
+	if tc.isServer {
+		out := localX25519
+		if useKyber {
+			pk, sk, err := kyber768.GenerateKeyPair(rand.Reader)
+			if err != nil {
+				return fmt.Errorf("generate kyber keypair: %w", err)
+			}
+			kyberPriv = *sk
+			pkBytes, err := pk.MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("marshal kyber public key: %w", err)
+			}
+			out = append(append([]byte{}, localX25519...), pkBytes...)
+		}
+		if err := writeHandshakeMsg(rw, out); err != nil {
+			return fmt.Errorf("send handshake message: %w", err)
+		}
+
+		peerMsg, err := readHandshakeMsg(rw)
+		if err != nil {
+			return fmt.Errorf("read handshake message: %w", err)
+		}
+		if len(peerMsg) < 32 {
+			return fmt.Errorf("handshake message too short")
+		}
+		peerX25519 = peerMsg[:32]
+
+		if useKyber {
+			ct := peerMsg[32:]
+			ss, err := kyberPriv.Scheme().Decapsulate(&kyberPriv, ct)
+			if err != nil {
+				return fmt.Errorf("kyber decapsulate: %w", err)
+			}
+			kemShared = ss
+		}
+	} else {
+		peerMsg, err := readHandshakeMsg(rw)
+		if err != nil {
+			return fmt.Errorf("read handshake message: %w", err)
+		}
+		if len(peerMsg) < 32 {
+			return fmt.Errorf("handshake message too short")
+		}
+		peerX25519 = peerMsg[:32]
+
+		out := localX25519
+		if useKyber {
+			pk, err := kyber768.Scheme().UnmarshalBinaryPublicKey(peerMsg[32:])
+			if err != nil {
+				return fmt.Errorf("unmarshal kyber public key: %w", err)
+			}
+			ct, ss, err := kyber768.Scheme().Encapsulate(pk)
+			if err != nil {
+				return fmt.Errorf("kyber encapsulate: %w", err)
+			}
+			kemShared = ss
+			out = append(append([]byte{}, localX25519...), ct...)
+		}
+		if err := writeHandshakeMsg(rw, out); err != nil {
+			return fmt.Errorf("send handshake message: %w", err)
+		}
+	}
+
+	peerPub, err := curve.NewPublicKey(peerX25519)
+	if err != nil {
+		return fmt.Errorf("parse peer public key: %w", err)
+	}
+	x25519Shared, err := priv.ECDH(peerPub)
+	if err != nil {
+		return fmt.Errorf("x25519 ecdh: %w", err)
+	}
+	sharedSecret := append(x25519Shared, kemShared...)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	epoch := tc.epoch
+	if tc.ready {
+		epoch++
+	}
+	return tc.installKeys(sharedSecret, epoch)
 }
 
-func (tc *TunnelCrypto) deriveKeys() error {
-	// HKDF-SHA256 to derive 64 bytes of key material
-	hkdfReader := hkdf.New(sha256.New, tc.secret, []byte("smtp-tunnel-v1"), []byte("tunnel-keys"))
+// installKeys derives sendKey/recvKey for epoch from sharedSecret and
+// resets per-epoch sequence numbers. Callers must hold tc.mu.
+func (tc *TunnelCrypto) installKeys(sharedSecret []byte, epoch uint32) error {
+	info := fmt.Sprintf("tunnel-keys-epoch-%d", epoch)
+	hkdfReader := hkdf.New(sha256.New, sharedSecret, tc.secret, []byte(info))
 	keyMaterial := make([]byte, 64)
 	if _, err := io.ReadFull(hkdfReader, keyMaterial); err != nil {
 		return fmt.Errorf("hkdf derive: %w", err)
@@ -60,12 +279,24 @@ func (tc *TunnelCrypto) deriveKeys() error {
 		tc.sendKey = c2sKey
 		tc.recvKey = s2cKey
 	}
+	tc.epoch = epoch
+	tc.sendSeq = 0
+	tc.recvSeq = 0
+	atomic.StoreUint64(&tc.sendBytes, 0)
+	tc.lastRekey = time.Now()
+	tc.ready = true
 	return nil
 }
 
-// Encrypt encrypts plaintext with ChaCha20-Poly1305.
-// Returns: nonce(12) + ciphertext + tag(16).
+// Encrypt encrypts plaintext with ChaCha20-Poly1305 under the current
+// epoch's session key. Returns: nonce(12) + ciphertext + tag(16).
 func (tc *TunnelCrypto) Encrypt(plaintext []byte) ([]byte, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.ready {
+		return nil, fmt.Errorf("tunnel crypto: handshake not yet performed")
+	}
+
 	aead, err := chacha20poly1305.New(tc.sendKey)
 	if err != nil {
 		return nil, err
@@ -73,19 +304,27 @@ func (tc *TunnelCrypto) Encrypt(plaintext []byte) ([]byte, error) {
 
 	seq := atomic.AddUint64(&tc.sendSeq, 1) - 1
 
-	// Nonce = seq(8 bytes big-endian) + random(4 bytes)
+	// Nonce = seq(8 bytes big-endian) + epoch(4 bytes big-endian). Session
+	// keys are re-derived every epoch, so a nonce only needs to be unique
+	// within one epoch's key, which the monotonic seq already guarantees
+	// without relying on randomness.
 	nonce := make([]byte, chacha20poly1305.NonceSize)
 	binary.BigEndian.PutUint64(nonce[:8], seq)
-	if _, err := rand.Read(nonce[8:]); err != nil {
-		return nil, err
-	}
+	binary.BigEndian.PutUint32(nonce[8:], tc.epoch)
 
 	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	atomic.AddUint64(&tc.sendBytes, uint64(len(plaintext)))
 	return ciphertext, nil
 }
 
 // Decrypt decrypts data encrypted with Encrypt.
 func (tc *TunnelCrypto) Decrypt(data []byte) ([]byte, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.ready {
+		return nil, fmt.Errorf("tunnel crypto: handshake not yet performed")
+	}
+
 	aead, err := chacha20poly1305.New(tc.recvKey)
 	if err != nil {
 		return nil, err
@@ -107,26 +346,53 @@ func (tc *TunnelCrypto) Decrypt(data []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// GenerateAuthToken creates an HMAC-SHA256 auth token for SMTP AUTH.
+// authTokenSkewSeconds bounds how far into the future a token's timestamp
+// may be, to tolerate modest clock drift between client and server without
+// accepting arbitrarily-future timestamps the way a symmetric Abs() check
+// would.
+const authTokenSkewSeconds int64 = 30
+
+// GenerateAuthToken creates an HMAC-SHA256 auth token for SMTP AUTH. A
+// random 128-bit nonce is mixed into the signed message so two tokens for
+// the same user and timestamp never carry the same MAC, which is what lets
+// VerifyAuthToken's ReplayCache key on the MAC alone. The token is a single
+// URL-safe base64 encoding of "username:timestamp:nonce:mac" rather than a
+// base64-inside-base64 wrapping.
 func GenerateAuthToken(secret, username string, timestamp int64) string {
-	msg := fmt.Sprintf("smtp-tunnel-auth:%s:%d", username, timestamp)
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		// rand.Read only fails if the OS CSPRNG is unavailable, which
+		// nothing in this codebase can recover from; a zero nonce would
+		// silently defeat the replay protection this exists for, so panic
+		// instead of returning a degraded token.
+		panic(fmt.Sprintf("crypto: read random nonce: %v", err))
+	}
+	nonceHex := hex.EncodeToString(nonce[:])
+
+	msg := fmt.Sprintf("smtp-tunnel-auth:%s:%d:%s", username, timestamp, nonceHex)
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write([]byte(msg))
-	macBytes := mac.Sum(nil)
-	token := fmt.Sprintf("%s:%d:%s", username, timestamp, base64.StdEncoding.EncodeToString(macBytes))
-	return base64.StdEncoding.EncodeToString([]byte(token))
+	macHex := hex.EncodeToString(mac.Sum(nil))
+
+	payload := fmt.Sprintf("%s:%d:%s:%s", username, timestamp, nonceHex, macHex)
+	return base64.URLEncoding.EncodeToString([]byte(payload))
 }
 
-// VerifyAuthToken verifies an auth token against known users.
-// Returns (valid, username).
-func VerifyAuthToken(token string, users map[string]string, maxAge int64) (bool, string) {
-	decoded, err := base64.StdEncoding.DecodeString(token)
+// VerifyAuthToken verifies an auth token against known users, rejecting it
+// if replay has already consumed its MAC within maxAge. Returns (valid,
+// username). replay may be nil to skip replay tracking.
+//
+// Secret lookup runs over every entry in users regardless of whether
+// username is present, so the time this takes doesn't reveal whether
+// username is configured.
+func VerifyAuthToken(token string, users map[string]string, maxAge int64, replay *ReplayCache) (bool, string) {
+	decoded, err := base64.URLEncoding.DecodeString(token)
 	if err != nil {
 		return false, ""
 	}
 
-	parts := strings.SplitN(string(decoded), ":", 3)
-	if len(parts) != 3 {
+	parts := strings.SplitN(string(decoded), ":", 4)
+	if len(parts) != 4 {
 		return false, ""
 	}
 
@@ -135,25 +401,71 @@ func VerifyAuthToken(token string, users map[string]string, maxAge int64) (bool,
 	if err != nil {
 		return false, ""
 	}
+	nonceHex := parts[2]
+	mac, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false, ""
+	}
 
-	// Check freshness
 	now := time.Now().Unix()
-	if math.Abs(float64(now-timestamp)) > float64(maxAge) {
+	if timestamp < now-maxAge || timestamp > now+authTokenSkewSeconds {
+		return false, ""
+	}
+
+	msg := fmt.Sprintf("smtp-tunnel-auth:%s:%d:%s", username, timestamp, nonceHex)
+
+	var matched bool
+	for name, secret := range users {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte(msg))
+		if hmac.Equal(mac, h.Sum(nil)) && name == username {
+			matched = true
+		}
+	}
+	if !matched {
 		return false, ""
 	}
 
-	// Look up user secret
-	secret, ok := users[username]
-	if !ok {
+	if replay != nil && replay.Seen(mac) {
 		return false, ""
 	}
 
-	// Regenerate expected token and compare
-	expected := GenerateAuthToken(secret, username, timestamp)
-	if hmac.Equal([]byte(token), []byte(expected)) {
-		return true, username
+	return true, username
+}
+
+// GeneratePasswordToken builds an AUTH token that carries the shared secret
+// directly instead of an HMAC over it. Use this when the server verifies
+// against a one-way hash (e.g. a bcrypt-backed htpasswd file) and so cannot
+// recompute an HMAC that would require holding the raw secret.
+func GeneratePasswordToken(username, secret string) string {
+	timestamp := time.Now().Unix()
+	token := fmt.Sprintf("%s:%d:%s", username, timestamp, secret)
+	return base64.StdEncoding.EncodeToString([]byte(token))
+}
+
+// ParsePasswordToken decodes a token produced by GeneratePasswordToken,
+// rejecting it if older than maxAge seconds. Returns the username and the
+// secret the client presented.
+func ParsePasswordToken(token string, maxAge int64) (username, secret string, ok bool) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", false
 	}
-	return false, ""
+
+	parts := strings.SplitN(string(decoded), ":", 3)
+	if len(parts) != 3 {
+		return "", "", false
+	}
+
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	if math.Abs(float64(time.Now().Unix()-timestamp)) > float64(maxAge) {
+		return "", "", false
+	}
+
+	return parts[0], parts[2], true
 }
 
 // GenerateSecret creates a crypto-random base64url secret.
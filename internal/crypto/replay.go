@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers recently-seen auth token MACs so VerifyAuthToken can
+// reject a replay of the same token within its validity window, bounded so
+// a flood of distinct tokens can't grow the cache without limit. Entries are
+// keyed by sha256(mac) rather than the mac itself, so the cache never holds
+// anything an attacker could use to reconstruct a valid token.
+type ReplayCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front = most recently seen
+}
+
+type replayEntry struct {
+	key  string
+	seen time.Time
+}
+
+// NewReplayCache creates a cache that remembers a MAC for ttl (matching the
+// Verify call's maxAge) and holds at most maxEntries at once, evicting the
+// least-recently-seen entry once full.
+func NewReplayCache(ttl time.Duration, maxEntries int) *ReplayCache {
+	return &ReplayCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Seen reports whether mac has already been recorded within ttl and, if
+// not, atomically records it as seen.
+func (c *ReplayCache) Seen(mac []byte) bool {
+	sum := sha256.Sum256(mac)
+	key := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := c.entries[key]; ok {
+		if now.Sub(el.Value.(*replayEntry).seen) < c.ttl {
+			return true
+		}
+		// Expired: fall through and re-record it as a fresh sighting.
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+
+	c.order.PushFront(&replayEntry{key: key, seen: now})
+	c.entries[key] = c.order.Front()
+
+	for c.maxEntries > 0 && len(c.entries) > c.maxEntries {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*replayEntry).key)
+	}
+
+	return false
+}
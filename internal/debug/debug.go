@@ -9,10 +9,20 @@ import (
 	"time"
 
 	"smtptunnel/internal/config"
+	"smtptunnel/internal/dialer"
+	"smtptunnel/internal/pinning"
 	"smtptunnel/internal/smtp"
 	"smtptunnel/internal/tunnel"
 )
 
+// dialServer dials cfg.Client.Server directly, or through upstream if set.
+func dialServer(cfg *config.Config, upstream *dialer.Chain, timeout time.Duration) (net.Conn, error) {
+	if upstream != nil {
+		return upstream.DialTimeout("tcp", cfg.Client.Server, timeout)
+	}
+	return net.DialTimeout("tcp", cfg.Client.Server, timeout)
+}
+
 // PingResult stores a single ping measurement.
 type PingResult struct {
 	Seq int
@@ -20,20 +30,20 @@ type PingResult struct {
 	Err error
 }
 
-// Ping connects to the server and measures round-trip time.
-func Ping(cfg *config.Config, tlsCfg *tls.Config, count int) ([]PingResult, error) {
+// Ping connects to the server and measures round-trip time. upstream, if
+// non-nil, dials through a chain of proxies instead of directly.
+func Ping(cfg *config.Config, tlsCfg *tls.Config, upstream *dialer.Chain, count int) ([]PingResult, error) {
 	if count <= 0 {
 		count = 4
 	}
 
-	// Connect
-	rawConn, err := net.DialTimeout("tcp", cfg.Client.Server, 10*time.Second)
+	rawConn, err := dialServer(cfg, upstream, 10*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
 
 	serverHost := smtp.HostFromAddr(cfg.Client.Server)
-	tlsConn, err := smtp.ClientHandshake(rawConn, serverHost, cfg.Client.Username, cfg.Client.Secret, tlsCfg)
+	tlsConn, err := smtp.ClientHandshake(rawConn, serverHost, cfg.Client.Username, cfg.Client.Secret, cfg.Client.AuthMode, tlsCfg, false)
 	if err != nil {
 		rawConn.Close()
 		return nil, fmt.Errorf("handshake: %w", err)
@@ -98,12 +108,17 @@ func FormatPingResults(server string, results []PingResult) string {
 	return sb.String()
 }
 
-// Status checks connectivity to the server.
-func Status(cfg *config.Config, tlsCfg *tls.Config) string {
+// Status checks connectivity to the server. pinDesc describes which
+// certificate verification mode buildTLSConfig selected (system roots, a
+// CACert, or DANE/MTA-STS pinning); verifier, if non-nil, reports which
+// specific pin matched once the TLS handshake below has run. upstream, if
+// non-nil, dials through a chain of proxies instead of directly.
+func Status(cfg *config.Config, tlsCfg *tls.Config, pinDesc string, verifier *pinning.Verifier, upstream *dialer.Chain) string {
 	var sb strings.Builder
 
 	sb.WriteString(fmt.Sprintf("Server: %s\n", cfg.Client.Server))
 	sb.WriteString(fmt.Sprintf("Username: %s\n", cfg.Client.Username))
+	sb.WriteString(fmt.Sprintf("Certificate verification: %s\n", pinDesc))
 	sb.WriteString(fmt.Sprintf("SOCKS proxies: %d\n", len(cfg.Client.Socks)))
 	for _, s := range cfg.Client.Socks {
 		auth := "none"
@@ -117,7 +132,7 @@ func Status(cfg *config.Config, tlsCfg *tls.Config) string {
 	sb.WriteString("\nConnectivity:\n")
 
 	start := time.Now()
-	conn, err := net.DialTimeout("tcp", cfg.Client.Server, 10*time.Second)
+	conn, err := dialServer(cfg, upstream, 10*time.Second)
 	if err != nil {
 		sb.WriteString(fmt.Sprintf("  TCP: FAIL (%v)\n", err))
 		return sb.String()
@@ -128,7 +143,7 @@ func Status(cfg *config.Config, tlsCfg *tls.Config) string {
 	// Test TLS + SMTP handshake
 	start = time.Now()
 	serverHost := smtp.HostFromAddr(cfg.Client.Server)
-	tlsConn, err := smtp.ClientHandshake(conn, serverHost, cfg.Client.Username, cfg.Client.Secret, tlsCfg)
+	tlsConn, err := smtp.ClientHandshake(conn, serverHost, cfg.Client.Username, cfg.Client.Secret, cfg.Client.AuthMode, tlsCfg, false)
 	if err != nil {
 		sb.WriteString(fmt.Sprintf("  Handshake: FAIL (%v)\n", err))
 		conn.Close()
@@ -138,6 +153,9 @@ func Status(cfg *config.Config, tlsCfg *tls.Config) string {
 	sb.WriteString(fmt.Sprintf("  Handshake: OK (%v)\n", hsTime.Round(time.Microsecond)))
 	sb.WriteString("  Auth: OK\n")
 	sb.WriteString("  Binary mode: OK\n")
+	if verifier != nil {
+		sb.WriteString(fmt.Sprintf("  Pin matched: %s\n", verifier.Matched()))
+	}
 
 	tlsConn.Close()
 
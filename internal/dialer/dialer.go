@@ -0,0 +1,82 @@
+// Package dialer implements chained upstream proxying for the tunnel
+// client's outbound connection, so it can reach the SMTP server through one
+// or more SOCKS5/HTTP CONNECT/Tor hops instead of a direct TCP dial.
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Hop describes a single proxy in an upstream chain.
+type Hop struct {
+	// Type is "socks5", "http-connect", or "tor" (SOCKS5 with a default
+	// Tor SOCKS addr of 127.0.0.1:9050 when Addr is empty).
+	Type     string
+	Addr     string
+	Username string
+	Password string
+}
+
+// Chain dials through an ordered sequence of Hops, each tunneled inside the
+// previous one, so the final connection to a destination address is only
+// ever visible to the first hop as a connection to the second hop, and so
+// on. An empty Chain dials directly.
+type Chain struct {
+	dialer proxy.Dialer
+}
+
+// NewChain builds a Chain from an ordered list of hops. With no hops, the
+// returned Chain dials directly.
+func NewChain(hops []Hop) (*Chain, error) {
+	var d proxy.Dialer = proxy.Direct
+	for _, hop := range hops {
+		nd, err := wrapHop(hop, d)
+		if err != nil {
+			return nil, err
+		}
+		d = nd
+	}
+	return &Chain{dialer: d}, nil
+}
+
+func wrapHop(hop Hop, forward proxy.Dialer) (proxy.Dialer, error) {
+	switch hop.Type {
+	case "socks5", "tor":
+		addr := hop.Addr
+		if hop.Type == "tor" && addr == "" {
+			addr = "127.0.0.1:9050"
+		}
+		var auth *proxy.Auth
+		if hop.Username != "" {
+			auth = &proxy.Auth{User: hop.Username, Password: hop.Password}
+		}
+		return proxy.SOCKS5("tcp", addr, auth, forward)
+
+	case "http-connect":
+		if hop.Addr == "" {
+			return nil, fmt.Errorf("dialer: http-connect hop has no addr")
+		}
+		return &httpConnectDialer{addr: hop.Addr, username: hop.Username, password: hop.Password, forward: forward}, nil
+
+	default:
+		return nil, fmt.Errorf("dialer: unknown upstream type %q", hop.Type)
+	}
+}
+
+// DialTimeout dials addr through the chain. timeout is applied as a context
+// deadline only when the chain's last hop implements proxy.ContextDialer (a
+// direct dial, or a socks5/tor hop); an http-connect hop takes no context,
+// so a chain ending in one is dialed with no timeout at all.
+func (c *Chain) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if cd, ok := c.dialer.(proxy.ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return cd.DialContext(ctx, network, addr)
+	}
+	return c.dialer.Dial(network, addr)
+}
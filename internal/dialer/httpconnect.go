@@ -0,0 +1,54 @@
+package dialer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// httpConnectDialer tunnels through an HTTP proxy with a CONNECT request,
+// implementing proxy.Dialer so it composes with the SOCKS5/Tor hops in a
+// Chain.
+type httpConnectDialer struct {
+	addr     string
+	username string
+	password string
+	forward  proxy.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialer: http-connect: dial %s: %w", d.addr, err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dialer: http-connect: write request: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dialer: http-connect: read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("dialer: http-connect to %s via %s: %s", addr, d.addr, resp.Status)
+	}
+
+	return conn, nil
+}
@@ -2,33 +2,107 @@
 package forward
 
 import (
+	"bufio"
+	"encoding/base64"
 	"log"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"smtptunnel/internal/metrics"
+	"smtptunnel/internal/proto"
+	"smtptunnel/internal/socks5"
 	"smtptunnel/internal/tunnel"
 )
 
+// defaultUDPIdleTimeout is how long a UDP NAT session may sit idle before
+// the janitor reaps it and tears down the backing tunnel channel, when
+// Forwarder.UDPIdleTimeout is left unset.
+const defaultUDPIdleTimeout = 60 * time.Second
+
 // Forwarder listens on a local address and forwards connections through the tunnel.
 type Forwarder struct {
 	ListenAddr  string
 	ForwardAddr string
-	Protocol    string // "tcp" or "udp"
+	Protocol    string // "tcp", "udp", "socks5", or "http-connect"
 	Tunnel      *tunnel.Client
 	Logger      *log.Logger
 
+	// Username/Password gate access when Protocol is "socks5" or
+	// "http-connect"; unused otherwise.
+	Username string
+	Password string
+
+	// UDPIdleTimeout overrides defaultUDPIdleTimeout for Protocol == "udp";
+	// zero means use the default.
+	UDPIdleTimeout time.Duration
+
 	listener net.Listener
 	udpConn  *net.UDPConn
 	closed   int32
+
+	udpSessions map[string]*udpSession
+	udpMu       sync.Mutex
+	udpDone     chan struct{}
+
+	socksSrv *socks5.Server
+}
+
+// udpSession is a NAT-style mapping from a client's UDP source address to
+// the tunnel channel carrying its traffic, keyed by clientAddr.String().
+type udpSession struct {
+	channelID  uint16
+	clientAddr *net.UDPAddr
+	lastActive int64 // unix nano, atomic
+}
+
+// udpReplyWriter routes inbound FrameData for a UDP session's channel back
+// to the originating client address on the forwarder's shared UDP socket.
+type udpReplyWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (w *udpReplyWriter) Write(p []byte) (int, error) {
+	return w.conn.WriteToUDP(p, w.addr)
+}
+
+// Close is a no-op: the underlying socket is shared across all sessions and
+// is closed by Forwarder.Close, not by individual channel teardown.
+func (w *udpReplyWriter) Close() error {
+	return nil
 }
 
 // ListenAndServe starts the forwarder. Blocks until Close() or error.
 func (f *Forwarder) ListenAndServe() error {
-	if f.Protocol == "udp" {
+	switch f.Protocol {
+	case "udp":
 		return f.listenUDP()
+	case "socks5":
+		return f.listenSOCKS5()
+	case "http-connect":
+		return f.listenHTTPConnect()
+	default:
+		return f.listenTCP()
 	}
-	return f.listenTCP()
+}
+
+// listenSOCKS5 delegates to a socks5.Server instead of reimplementing the
+// protocol here, so ForwardAddr is ignored and each request's own
+// (host, port) is tunneled instead.
+func (f *Forwarder) listenSOCKS5() error {
+	srv := &socks5.Server{
+		ListenAddr: f.ListenAddr,
+		Username:   f.Username,
+		Password:   f.Password,
+		Tunnel:     f.Tunnel,
+		Logger:     f.Logger,
+	}
+	f.socksSrv = srv
+	return srv.ListenAndServe()
 }
 
 func (f *Forwarder) listenTCP() error {
@@ -70,7 +144,7 @@ func (f *Forwarder) handleTCPConn(conn net.Conn) {
 		return
 	}
 
-	channelID, success := f.Tunnel.OpenChannel(host, uint16(port))
+	channelID, success, _ := f.Tunnel.OpenChannel(host, uint16(port))
 	if !success {
 		f.Logger.Printf("Forward: tunnel connect failed to %s", f.ForwardAddr)
 		return
@@ -80,11 +154,128 @@ func (f *Forwarder) handleTCPConn(conn net.Conn) {
 	conn.SetDeadline(time.Time{})
 	f.Tunnel.RegisterChannel(channelID, conn)
 
+	metrics.ActiveStreams.WithLabelValues("tcp").Inc()
+	defer func() {
+		f.Tunnel.CloseChannelRemote(channelID)
+		f.Tunnel.CloseChannel(channelID)
+		metrics.ActiveStreams.WithLabelValues("tcp").Dec()
+	}()
+
+	buf := make([]byte, 32768)
+	for {
+		if !f.Tunnel.Connected() {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if sendErr := f.Tunnel.SendData(channelID, buf[:n]); sendErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+// listenHTTPConnect runs an HTTP CONNECT proxy: ForwardAddr is ignored and
+// the destination (host, port) comes from each request's CONNECT line.
+func (f *Forwarder) listenHTTPConnect() error {
+	ln, err := net.Listen("tcp", f.ListenAddr)
+	if err != nil {
+		return err
+	}
+	f.listener = ln
+	f.Logger.Printf("HTTP CONNECT proxy on %s", f.ListenAddr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&f.closed) == 1 {
+				return nil
+			}
+			continue
+		}
+		go f.handleHTTPConnectConn(conn)
+	}
+}
+
+func (f *Forwarder) handleHTTPConnectConn(conn net.Conn) {
+	defer conn.Close()
+
+	if !f.Tunnel.Connected() {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return
+	}
+
+	if f.Username != "" || f.Password != "" {
+		if !checkProxyAuth(req, f.Username, f.Password) {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"smtptunnel\"\r\n\r\n"))
+			return
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+
+	f.Logger.Printf("HTTP CONNECT %s:%d", host, port)
+
+	channelID, success, reason := f.Tunnel.OpenChannel(host, uint16(port))
+	if !success {
+		if reason == proto.ConnectFailQuotaExceeded || reason == proto.ConnectFailChannelLimit {
+			conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+		} else {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		}
+		return
+	}
+
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	conn.SetDeadline(time.Time{})
+	f.Tunnel.RegisterChannel(channelID, conn)
+
+	metrics.ActiveStreams.WithLabelValues("http-connect").Inc()
 	defer func() {
 		f.Tunnel.CloseChannelRemote(channelID)
 		f.Tunnel.CloseChannel(channelID)
+		metrics.ActiveStreams.WithLabelValues("http-connect").Dec()
 	}()
 
+	// bufio.NewReader may have buffered bytes past the CONNECT request's
+	// blank line if the client pipelined data; flush those before
+	// streaming the raw socket so nothing is dropped.
+	if n := reader.Buffered(); n > 0 {
+		buffered := make([]byte, n)
+		reader.Read(buffered)
+		if sendErr := f.Tunnel.SendData(channelID, buffered); sendErr != nil {
+			return
+		}
+	}
+
 	buf := make([]byte, 32768)
 	for {
 		if !f.Tunnel.Connected() {
@@ -106,6 +297,30 @@ func (f *Forwarder) handleTCPConn(conn net.Conn) {
 	}
 }
 
+// checkProxyAuth validates HTTP Basic credentials against username and
+// password, checking both the standard Authorization header and the
+// Proxy-Authorization header conventionally used by CONNECT proxies.
+func checkProxyAuth(req *http.Request, username, password string) bool {
+	if u, p, ok := req.BasicAuth(); ok {
+		return u == username && p == password
+	}
+
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	return parts[0] == username && parts[1] == password
+}
+
 func (f *Forwarder) listenUDP() error {
 	addr, err := net.ResolveUDPAddr("udp", f.ListenAddr)
 	if err != nil {
@@ -116,8 +331,12 @@ func (f *Forwarder) listenUDP() error {
 		return err
 	}
 	f.udpConn = conn
+	f.udpSessions = make(map[string]*udpSession)
+	f.udpDone = make(chan struct{})
 	f.Logger.Printf("Forward %s -> %s (UDP)", f.ListenAddr, f.ForwardAddr)
 
+	go f.udpJanitor()
+
 	buf := make([]byte, 65535)
 	for {
 		if atomic.LoadInt32(&f.closed) == 1 {
@@ -137,30 +356,103 @@ func (f *Forwarder) listenUDP() error {
 		}
 
 		if n > 0 && f.Tunnel.Connected() {
-			go f.handleUDPPacket(buf[:n], remoteAddr)
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			f.handleUDPPacket(data, remoteAddr)
 		}
 	}
 }
 
-func (f *Forwarder) handleUDPPacket(data []byte, _ *net.UDPAddr) {
-	host, portStr, err := net.SplitHostPort(f.ForwardAddr)
-	if err != nil {
+// handleUDPPacket routes a packet from a UDP client through its NAT session,
+// opening a new tunnel channel on first contact and reusing it for the
+// lifetime of the session so replies can be written back to remoteAddr.
+func (f *Forwarder) handleUDPPacket(data []byte, remoteAddr *net.UDPAddr) {
+	// A channel carries exactly one FrameData per datagram (see
+	// tunnel.Client.SendData), so a packet bigger than MaxPayloadSize can't
+	// be split across frames without corrupting the datagram boundary on
+	// the other end. Drop it, mirroring how a SOCKS5 client with FRAG=0
+	// must simply not split the datagram either.
+	if len(data) > proto.MaxPayloadSize {
+		f.Logger.Printf("Forward: dropping oversized UDP packet from %s (%d bytes)", remoteAddr, len(data))
 		return
 	}
-	port, err := net.LookupPort("udp", portStr)
-	if err != nil {
-		return
+
+	key := remoteAddr.String()
+
+	f.udpMu.Lock()
+	sess, ok := f.udpSessions[key]
+	f.udpMu.Unlock()
+
+	if !ok {
+		host, portStr, err := net.SplitHostPort(f.ForwardAddr)
+		if err != nil {
+			return
+		}
+		port, err := net.LookupPort("udp", portStr)
+		if err != nil {
+			return
+		}
+
+		channelID, success, _ := f.Tunnel.OpenUDPChannel(host, uint16(port))
+		if !success {
+			f.Logger.Printf("Forward: UDP tunnel connect failed to %s for %s", f.ForwardAddr, key)
+			return
+		}
+
+		sess = &udpSession{channelID: channelID, clientAddr: remoteAddr}
+		f.udpMu.Lock()
+		f.udpSessions[key] = sess
+		f.udpMu.Unlock()
+
+		f.Tunnel.RegisterChannel(channelID, &udpReplyWriter{conn: f.udpConn, addr: remoteAddr})
+		f.Logger.Printf("Forward: new UDP session %s -> ch=%d", key, channelID)
+		metrics.ActiveStreams.WithLabelValues("udp").Inc()
 	}
 
-	channelID, success := f.Tunnel.OpenChannel(host, uint16(port))
-	if !success {
-		return
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+	f.Tunnel.SendData(sess.channelID, data)
+}
+
+// udpJanitor periodically expires idle UDP sessions and tears down their
+// backing tunnel channels.
+func (f *Forwarder) udpJanitor() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.udpDone:
+			return
+		case <-ticker.C:
+			f.reapIdleUDPSessions()
+		}
+	}
+}
+
+func (f *Forwarder) reapIdleUDPSessions() {
+	idleTimeout := f.UDPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+
+	now := time.Now()
+
+	f.udpMu.Lock()
+	var expired []uint16
+	for key, sess := range f.udpSessions {
+		last := time.Unix(0, atomic.LoadInt64(&sess.lastActive))
+		if now.Sub(last) > idleTimeout {
+			expired = append(expired, sess.channelID)
+			delete(f.udpSessions, key)
+		}
 	}
+	f.udpMu.Unlock()
 
-	f.Tunnel.SendData(channelID, data)
-	// Close channel after sending — UDP is stateless per packet
-	f.Tunnel.CloseChannelRemote(channelID)
-	f.Tunnel.CloseChannel(channelID)
+	for _, channelID := range expired {
+		f.Tunnel.CloseChannelRemote(channelID)
+		f.Tunnel.CloseChannel(channelID)
+		metrics.ActiveStreams.WithLabelValues("udp").Dec()
+	}
 }
 
 // Close stops the forwarder.
@@ -172,4 +464,14 @@ func (f *Forwarder) Close() {
 	if f.udpConn != nil {
 		f.udpConn.Close()
 	}
+	if f.udpDone != nil {
+		select {
+		case <-f.udpDone:
+		default:
+			close(f.udpDone)
+		}
+	}
+	if f.socksSrv != nil {
+		f.socksSrv.Close()
+	}
 }
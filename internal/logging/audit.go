@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"smtptunnel/internal/config"
+)
+
+// Auditor emits one JSON event per security-relevant occurrence - auth
+// outcomes, per-channel connects/disconnects, and service install/remove -
+// as a structured stream separate from the human-readable *log.Logger used
+// elsewhere, so a downstream SIEM can reconstruct a per-user audit trail
+// without scraping free-text log lines. A nil *Auditor is valid and every
+// method on it is a no-op, so call sites don't need to check
+// config.AuditConfig.Enabled themselves.
+type Auditor struct {
+	log           *slog.Logger
+	redactTargets bool
+	closer        io.Closer
+}
+
+// NewAuditor builds an Auditor from cfg, or returns nil if cfg.Enabled is
+// false. With cfg.Path set, events are written to that file and rotated via
+// lumberjack (as dnscrypt-proxy does); left blank, events go to stdout
+// alongside the rest of the server's output.
+func NewAuditor(cfg config.AuditConfig) *Auditor {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	var closer io.Closer
+	if cfg.Path != "" {
+		lj := &lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxAge:     cfg.MaxAgeDays,
+			MaxBackups: cfg.MaxBackups,
+			Compress:   true,
+		}
+		w = lj
+		closer = lj
+	}
+
+	return &Auditor{
+		log:           slog.New(slog.NewJSONHandler(w, nil)),
+		redactTargets: cfg.RedactTargets,
+		closer:        closer,
+	}
+}
+
+// Close releases the rotated log file, if any. Safe to call on a nil Auditor.
+func (a *Auditor) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// Auth records the outcome of an AUTH/mTLS attempt: username may be empty if
+// the token didn't resolve to a known user.
+func (a *Auditor) Auth(username, remoteIP string, ok bool, reason string) {
+	if a == nil {
+		return
+	}
+	a.log.Info("auth",
+		"username", username,
+		"remote_ip", remoteIP,
+		"outcome", outcomeString(ok),
+		"reason", reason,
+	)
+}
+
+// Connect records a channel CONNECT, identifying the session by tunnelID so
+// its eventual Disconnect can be correlated back to it.
+func (a *Auditor) Connect(tunnelID, username, remoteIP, network, target string) {
+	if a == nil {
+		return
+	}
+	a.log.Info("connect",
+		"tunnel_id", tunnelID,
+		"username", username,
+		"remote_ip", remoteIP,
+		"network", network,
+		"target", a.redact(target),
+	)
+}
+
+// Disconnect records a channel closing, with the total bytes relayed in each
+// direction over its lifetime.
+func (a *Auditor) Disconnect(tunnelID, username string, bytesIn, bytesOut uint64) {
+	if a == nil {
+		return
+	}
+	a.log.Info("disconnect",
+		"tunnel_id", tunnelID,
+		"username", username,
+		"bytes_in", bytesIn,
+		"bytes_out", bytesOut,
+	)
+}
+
+// Service records a service install/remove outcome (see internal/service),
+// which otherwise only ever went to fmt.Printf.
+func (a *Auditor) Service(event, name string, err error) {
+	if a == nil {
+		return
+	}
+	if err != nil {
+		a.log.Info(event, "service", name, "outcome", "failure", "error", err.Error())
+		return
+	}
+	a.log.Info(event, "service", name, "outcome", "success")
+}
+
+// redact replaces target's hostname with a truncated SHA-256 hash (keeping
+// the port) when redactTargets is set, so audit logs can confirm connection
+// counts and timing without recording exactly which hosts a user visited.
+func (a *Auditor) redact(target string) string {
+	if !a.redactTargets {
+		return target
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return hashHost(target)
+	}
+	return hashHost(host) + ":" + port
+}
+
+func hashHost(host string) string {
+	sum := sha256.Sum256([]byte(host))
+	return "redacted-" + hex.EncodeToString(sum[:8])
+}
+
+func outcomeString(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
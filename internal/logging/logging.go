@@ -0,0 +1,30 @@
+// Package logging builds the client's *log.Logger on top of log/slog, so
+// existing Printf-style call sites throughout the codebase get structured
+// text or JSON output for free.
+package logging
+
+import (
+	"log"
+	"log/slog"
+	"os"
+)
+
+// New returns a *log.Logger backed by a log/slog handler. format is "json"
+// for structured JSON output, or anything else (including "") for slog's
+// human-readable text format. debug enables slog.LevelDebug.
+func New(format string, debug bool) *log.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+
+	return slog.NewLogLogger(handler, level)
+}
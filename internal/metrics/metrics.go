@@ -0,0 +1,71 @@
+// Package metrics exposes Prometheus counters/gauges for the tunnel client
+// and a /metrics + /healthz HTTP endpoint, so the client is operable from a
+// standard SRE stack instead of just `service logs`.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Reconnects counts every time the client re-dials the server after the
+	// initial connection.
+	Reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtptunnel_reconnects_total",
+		Help: "Total number of tunnel reconnect attempts.",
+	})
+
+	// HandshakeSeconds observes how long the SMTP+STARTTLS+AUTH handshake
+	// took for each connect attempt.
+	HandshakeSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtptunnel_handshake_seconds",
+		Help:    "Time spent completing the SMTP+TLS handshake.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// ActiveStreams tracks the number of currently open proxied streams, by
+	// protocol ("tcp", "udp", "socks5", "http-connect").
+	ActiveStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smtptunnel_active_streams",
+		Help: "Number of active proxied streams.",
+	}, []string{"proto"})
+
+	// BytesTotal counts bytes relayed through the tunnel, by direction
+	// ("up" = local to server, "down" = server to local).
+	BytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtptunnel_bytes_total",
+		Help: "Total bytes transferred through the tunnel.",
+	}, []string{"dir"})
+
+	// SocksAuthFailures counts rejected SOCKS5 username/password attempts.
+	SocksAuthFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtptunnel_socks_auth_failures_total",
+		Help: "Total SOCKS5 authentication failures.",
+	})
+)
+
+// HealthCheck reports whether the tunnel is currently connected, for the
+// /healthz endpoint.
+type HealthCheck func() bool
+
+// Serve starts the metrics HTTP server on listen, exposing /metrics and
+// /healthz. It blocks until the listener fails, mirroring
+// socks5.Server.ListenAndServe / forward.Forwarder.ListenAndServe.
+func Serve(listen string, healthy HealthCheck) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if healthy == nil || healthy() {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok\n"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("disconnected\n"))
+	})
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,195 @@
+// Package pinning implements DANE/MTA-STS-style certificate pinning for the
+// tunnel client: verifying a server's certificate against a fixed set of
+// SPKI/certificate digests instead of (or in addition to) the normal PKIX
+// chain, modeled on the MX delivery pinning used by real SMTP clients.
+package pinning
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a parsed DANE-style TLSA pin: "<usage> <selector> <matching-type>
+// <hex-digest>", e.g. "3 1 1 <sha256 of the leaf's SPKI>". Only usage 2
+// (DANE-TA: pin must appear somewhere in the presented chain) and usage 3
+// (DANE-EE: pin must be the leaf certificate) are supported; both bypass
+// PKIX chain validation entirely, per DANE semantics.
+type Record struct {
+	Usage        int
+	Selector     int
+	MatchingType int
+	Digest       []byte
+}
+
+// ParseRecord parses a single TLSA-style record string.
+func ParseRecord(s string) (Record, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 4 {
+		return Record{}, fmt.Errorf("pinning: malformed TLSA record %q (want \"usage selector matching-type hex-digest\")", s)
+	}
+	usage, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Record{}, fmt.Errorf("pinning: bad usage in %q: %w", s, err)
+	}
+	if usage != 2 && usage != 3 {
+		return Record{}, fmt.Errorf("pinning: unsupported TLSA usage %d in %q (only 2 DANE-TA and 3 DANE-EE are supported)", usage, s)
+	}
+	selector, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Record{}, fmt.Errorf("pinning: bad selector in %q: %w", s, err)
+	}
+	matchingType, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Record{}, fmt.Errorf("pinning: bad matching-type in %q: %w", s, err)
+	}
+	digest, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return Record{}, fmt.Errorf("pinning: bad hex digest in %q: %w", s, err)
+	}
+	return Record{Usage: usage, Selector: selector, MatchingType: matchingType, Digest: digest}, nil
+}
+
+// matches reports whether cert satisfies this record.
+func (rec Record) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch rec.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	var digest []byte
+	switch rec.MatchingType {
+	case 0:
+		digest = data
+	case 1:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		digest = sum[:]
+	default:
+		return false
+	}
+
+	return bytes.Equal(digest, rec.Digest)
+}
+
+// Verifier installs as a *tls.Config's VerifyPeerCertificate callback,
+// accepting the connection the moment any presented certificate matches any
+// configured Record (only the leaf, for a usage-3 Record), regardless of what the normal PKIX chain validation
+// would have said (tls.Config.InsecureSkipVerify must be set alongside it so
+// Go doesn't run that validation too).
+type Verifier struct {
+	records []Record
+
+	mu      sync.Mutex
+	matched string
+}
+
+// NewVerifier builds a Verifier for the given set of TLSA-style records.
+func NewVerifier(records []Record) *Verifier {
+	return &Verifier{records: records}
+}
+
+// VerifyPeerCertificate implements the tls.Config.VerifyPeerCertificate signature.
+func (v *Verifier) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("pinning: parse peer certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	for _, rec := range v.records {
+		for i, cert := range certs {
+			// A usage-3 (DANE-EE) record only ever matches the leaf.
+			if rec.Usage == 3 && i > 0 {
+				break
+			}
+			if rec.matches(cert) {
+				v.mu.Lock()
+				v.matched = fmt.Sprintf("usage=%d selector=%d type=%d subject=%q", rec.Usage, rec.Selector, rec.MatchingType, cert.Subject.CommonName)
+				v.mu.Unlock()
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("pinning: no TLSA record matched any presented certificate")
+}
+
+// Matched describes the record and certificate that last satisfied this
+// Verifier, for diagnostics (debug.Status). Empty until a successful
+// handshake has run VerifyPeerCertificate.
+func (v *Verifier) Matched() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.matched == "" {
+		return "(no match recorded yet)"
+	}
+	return v.matched
+}
+
+// policyFile is the on-disk shape of an MTA-STS-style pin policy.
+type policyFile struct {
+	Version       int                 `json:"version"`
+	FetchedAt     time.Time           `json:"fetched_at"`
+	MaxAgeSeconds int                 `json:"max_age_seconds"`
+	Hosts         map[string][]string `json:"hosts"`
+}
+
+// LoadPolicy reads an MTA-STS-style policy file from disk and returns the
+// TLSA-style records pinned for hostname, rejecting the policy if it has
+// expired (FetchedAt + MaxAgeSeconds) or has no entry for hostname. Unlike
+// real MTA-STS, the policy here isn't fetched or validated over HTTPS/DNS;
+// it's refreshed out of band and simply enforced locally with a max age, the
+// same trust model mox's smtpclient uses for its cached MX policies.
+func LoadPolicy(path, hostname string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("pinning: read policy file: %w", err)
+	}
+
+	var pf policyFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("pinning: parse policy file: %w", err)
+	}
+
+	if pf.MaxAgeSeconds <= 0 {
+		return nil, fmt.Errorf("pinning: policy file missing max_age_seconds")
+	}
+	maxAge := time.Duration(pf.MaxAgeSeconds) * time.Second
+	if time.Since(pf.FetchedAt) > maxAge {
+		return nil, fmt.Errorf("pinning: policy expired (fetched %s, max age %s)", pf.FetchedAt.Format(time.RFC3339), maxAge)
+	}
+
+	rawRecords, ok := pf.Hosts[hostname]
+	if !ok {
+		return nil, fmt.Errorf("pinning: policy has no entry for host %q", hostname)
+	}
+
+	records := make([]Record, 0, len(rawRecords))
+	for _, s := range rawRecords {
+		rec, err := ParseRecord(s)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -0,0 +1,210 @@
+// Package pki issues and renews mTLS client certificates signed by an
+// existing smtptunnel CA (see internal/certs, which creates the initial
+// CA/server pair), so the server can authenticate sessions by verified
+// client certificate instead of a shared secret.
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CA is a loaded certificate authority capable of signing new client leaf
+// certificates.
+type CA struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+// LoadCA reads a CA certificate and key previously written by
+// certs.Generate (as ca.crt/ca.key), so additional client certificates can
+// be issued without regenerating the CA itself.
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert: %w", err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("no PEM block in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse ca cert: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca key: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no PEM block in %s", keyFile)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse ca key: %w", err)
+	}
+
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// CAOptions controls generation of a new root CA.
+type CAOptions struct {
+	OutputDir string
+	Days      int
+	KeySize   int
+}
+
+// GenerateCA creates a fresh self-signed CA and writes ca.key/ca.crt to
+// opts.OutputDir, for deployments that want to issue mTLS client
+// certificates without regenerating the server's own TLS pair (see
+// certs.Generate, which bundles both into one call).
+func GenerateCA(opts CAOptions) (*CA, error) {
+	if opts.KeySize == 0 {
+		opts.KeySize = 2048
+	}
+	if opts.Days == 0 {
+		opts.Days = 3650
+	}
+
+	if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("create output dir: %w", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, opts.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("generate ca key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"SMTP Tunnel"},
+			CommonName:   "SMTP Tunnel Client CA",
+		},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(time.Duration(opts.Days) * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create ca cert: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse ca cert: %w", err)
+	}
+
+	keyPath := filepath.Join(opts.OutputDir, "ca.key")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		return nil, fmt.Errorf("write %s: %w", keyPath, err)
+	}
+	certPath := filepath.Join(opts.OutputDir, "ca.crt")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("write %s: %w", certPath, err)
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// ClientCertOptions controls a client leaf certificate issued for mTLS.
+type ClientCertOptions struct {
+	Username string
+	Days     int
+	KeySize  int
+}
+
+// IssueClientCert signs a new client-auth leaf certificate for
+// opts.Username against ca, returning the certificate and private key as
+// PEM bytes plus the certificate's lowercase hex SHA-256 fingerprint,
+// matching the format expected by config.UserEntry.ClientCertFingerprint.
+func IssueClientCert(ca *CA, opts ClientCertOptions) (certPEM, keyPEM []byte, fingerprint string, err error) {
+	if opts.KeySize == 0 {
+		opts.KeySize = 2048
+	}
+	if opts.Days == 0 {
+		opts.Days = 365
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, opts.KeySize)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("generate client key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("generate serial: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"SMTP Tunnel"},
+			CommonName:   opts.Username,
+		},
+		NotBefore:   time.Now().Add(-1 * time.Hour),
+		NotAfter:    time.Now().Add(time.Duration(opts.Days) * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("create client cert: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	fingerprint = Fingerprint(der)
+
+	return certPEM, keyPEM, fingerprint, nil
+}
+
+// Fingerprint returns the lowercase hex SHA-256 fingerprint of a DER-encoded
+// certificate, the format stored in config.UserEntry.ClientCertFingerprint.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteClientCert writes a client certificate/key pair to dir as
+// "<username>.crt" and "<username>.key", mirroring the file layout
+// certs.Generate uses for the server's own pair.
+func WriteClientCert(dir, username string, certPEM, keyPEM []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create certs dir: %w", err)
+	}
+	keyPath := filepath.Join(dir, username+".key")
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("write %s: %w", keyPath, err)
+	}
+	certPath := filepath.Join(dir, username+".crt")
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("write %s: %w", certPath, err)
+	}
+	return nil
+}
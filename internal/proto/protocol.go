@@ -10,13 +10,21 @@ import (
 
 // Frame types.
 const (
-	FrameData        byte = 0x01
-	FrameConnect     byte = 0x02
-	FrameConnectOK   byte = 0x03
-	FrameConnectFail byte = 0x04
-	FrameClose       byte = 0x05
-	FramePing        byte = 0x06
-	FramePong        byte = 0x07
+	FrameData         byte = 0x01
+	FrameConnect      byte = 0x02
+	FrameConnectOK    byte = 0x03
+	FrameConnectFail  byte = 0x04
+	FrameClose        byte = 0x05
+	FramePing         byte = 0x06
+	FramePong         byte = 0x07
+	FrameConnectUDP   byte = 0x08
+	FrameWindowAdjust byte = 0x09
+	FrameListen       byte = 0x0A
+	FrameListenOK     byte = 0x0B
+	FrameListenFail   byte = 0x0C
+	FrameAccept       byte = 0x0D
+	FrameRekeyReq     byte = 0x0E
+	FrameRekeyMsg     byte = 0x0F
 )
 
 // HeaderSize is the fixed header length: type(1) + channel_id(2) + payload_len(2).
@@ -44,16 +52,135 @@ func MakeConnectPayload(host string, port uint16) []byte {
 
 // ParseConnectPayload decodes host and port from a CONNECT frame payload.
 func ParseConnectPayload(payload []byte) (string, uint16, error) {
-	if len(payload) < 4 {
-		return "", 0, fmt.Errorf("connect payload too short")
+	host, port, _, err := parseAddr(payload)
+	return host, port, err
+}
+
+// parseAddr decodes a single MakeConnectPayload-encoded host:port from the
+// front of payload and reports how many bytes it consumed, so callers that
+// pack more than one address into a payload (see MakeListenPayload) can
+// decode the rest after it.
+func parseAddr(payload []byte) (string, uint16, int, error) {
+	if len(payload) < 3 {
+		return "", 0, 0, fmt.Errorf("address too short")
 	}
 	hostLen := int(payload[0])
-	if len(payload) < 1+hostLen+2 {
-		return "", 0, fmt.Errorf("connect payload truncated")
+	n := 1 + hostLen + 2
+	if len(payload) < n {
+		return "", 0, 0, fmt.Errorf("address truncated")
 	}
 	host := string(payload[1 : 1+hostLen])
-	port := binary.BigEndian.Uint16(payload[1+hostLen:])
-	return host, port, nil
+	port := binary.BigEndian.Uint16(payload[1+hostLen : n])
+	return host, port, n, nil
+}
+
+// MakeWindowAdjustPayload encodes a send-window increment for a
+// FrameWindowAdjust frame.
+func MakeWindowAdjustPayload(delta uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, delta)
+	return buf
+}
+
+// ParseWindowAdjustPayload decodes a window increment from a
+// FrameWindowAdjust frame's payload.
+func ParseWindowAdjustPayload(payload []byte) (uint32, error) {
+	if len(payload) < 4 {
+		return 0, fmt.Errorf("window adjust payload too short")
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// MakeListenPayload encodes a FrameListen request: the host:port the server
+// should bind, followed by the host:port on the client side that each
+// accepted connection should be relayed to.
+func MakeListenPayload(bindHost string, bindPort uint16, dstHost string, dstPort uint16) []byte {
+	buf := make([]byte, 0)
+	buf = append(buf, MakeConnectPayload(bindHost, bindPort)...)
+	buf = append(buf, MakeConnectPayload(dstHost, dstPort)...)
+	return buf
+}
+
+// ParseListenPayload decodes a FrameListen frame's bind and destination
+// addresses.
+func ParseListenPayload(payload []byte) (bindHost string, bindPort uint16, dstHost string, dstPort uint16, err error) {
+	bindHost, bindPort, n, err := parseAddr(payload)
+	if err != nil {
+		return "", 0, "", 0, fmt.Errorf("listen payload: bind: %w", err)
+	}
+	dstHost, dstPort, _, err = parseAddr(payload[n:])
+	if err != nil {
+		return "", 0, "", 0, fmt.Errorf("listen payload: target: %w", err)
+	}
+	return bindHost, bindPort, dstHost, dstPort, nil
+}
+
+// MakeListenResultPayload encodes the actual bound port for a FrameListenOK
+// frame, which may differ from the requested port when the request asked
+// for an ephemeral port (port 0).
+func MakeListenResultPayload(port uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, port)
+	return buf
+}
+
+// ParseListenResultPayload decodes the bound port from a FrameListenOK
+// frame's payload.
+func ParseListenResultPayload(payload []byte) (uint16, error) {
+	if len(payload) < 2 {
+		return 0, fmt.Errorf("listen result payload too short")
+	}
+	return binary.BigEndian.Uint16(payload), nil
+}
+
+// MakeAcceptPayload encodes, for a FrameAccept frame, the channel ID of the
+// FrameListen request that the new reverse channel (carried in the
+// FrameAccept frame's own ChannelID) belongs to, so the client can look up
+// which local target to relay the channel's data to.
+func MakeAcceptPayload(listenChannelID uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, listenChannelID)
+	return buf
+}
+
+// ParseAcceptPayload decodes the originating FrameListen channel ID from a
+// FrameAccept frame's payload.
+func ParseAcceptPayload(payload []byte) (uint16, error) {
+	if len(payload) < 2 {
+		return 0, fmt.Errorf("accept payload too short")
+	}
+	return binary.BigEndian.Uint16(payload), nil
+}
+
+// Reason codes for a FrameConnectFail payload encoding a policy rejection
+// rather than a dial failure. A dial failure's payload is instead the
+// free-form error text from the failed net.Dial/net.DialUDP call (see
+// serverSession.handleConnect), which is never exactly one byte long, so
+// ConnectFailReason can tell the two apart.
+const (
+	ConnectFailQuotaExceeded byte = 0x01
+	ConnectFailChannelLimit  byte = 0x02
+)
+
+// MakeConnectFailPayload encodes a policy-rejection reason for a
+// FrameConnectFail frame.
+func MakeConnectFailPayload(reason byte) []byte {
+	return []byte{reason}
+}
+
+// ConnectFailReason returns the policy-rejection reason code carried by a
+// FrameConnectFail payload, or 0 if payload is a dial failure's free-form
+// text (or empty, as sent for a malformed CONNECT request) rather than a
+// recognized single-byte reason.
+func ConnectFailReason(payload []byte) byte {
+	if len(payload) != 1 {
+		return 0
+	}
+	switch payload[0] {
+	case ConnectFailQuotaExceeded, ConnectFailChannelLimit:
+		return payload[0]
+	}
+	return 0
 }
 
 // FrameWriter provides thread-safe frame writing.
@@ -128,6 +255,22 @@ func TypeName(t byte) string {
 		return "PING"
 	case FramePong:
 		return "PONG"
+	case FrameConnectUDP:
+		return "CONNECT_UDP"
+	case FrameWindowAdjust:
+		return "WINDOW_ADJUST"
+	case FrameListen:
+		return "LISTEN"
+	case FrameListenOK:
+		return "LISTEN_OK"
+	case FrameListenFail:
+		return "LISTEN_FAIL"
+	case FrameAccept:
+		return "ACCEPT"
+	case FrameRekeyReq:
+		return "REKEY_REQ"
+	case FrameRekeyMsg:
+		return "REKEY_MSG"
 	default:
 		return fmt.Sprintf("UNKNOWN(0x%02x)", t)
 	}
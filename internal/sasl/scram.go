@@ -0,0 +1,380 @@
+// Package sasl implements the SASL mechanisms negotiated over the SMTP
+// cover channel: SCRAM-SHA-256, SCRAM-SHA-1, and EXTERNAL. It replaces a
+// single fixed AUTH token with the real multi-round client-first /
+// server-first / client-final / server-final exchange used by mainstream
+// SMTP clients and servers (RFC 5802, RFC 7677).
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ScramHash selects SCRAM's underlying hash algorithm.
+type ScramHash int
+
+const (
+	ScramSHA256 ScramHash = iota
+	ScramSHA1
+)
+
+// Name returns the SASL mechanism name, as advertised in EHLO/AUTH.
+func (h ScramHash) Name() string {
+	if h == ScramSHA1 {
+		return "SCRAM-SHA-1"
+	}
+	return "SCRAM-SHA-256"
+}
+
+func (h ScramHash) new() func() hash.Hash {
+	if h == ScramSHA1 {
+		return sha1.New
+	}
+	return sha256.New
+}
+
+// scramIterations is the PBKDF2 iteration count used to derive credentials.
+// This package has no persistent salt/iteration store (see DeriveCredential),
+// so it's a fixed constant rather than per-user tunable.
+const scramIterations = 4096
+
+// Credential is the salted verifier SCRAM authenticates against. It never
+// contains the raw secret or SaltedPassword, only values derived one-way
+// from it, and is what the server side stores/looks up.
+type Credential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// DeriveCredential computes the SCRAM salted credential for username/secret
+// under hash algorithm h. Real SCRAM deployments store Salt and Iterations
+// per-user; this tunnel has no separate credential store, so the salt is
+// instead derived deterministically from the secret itself (an HMAC keyed
+// by the secret over the username), so the same username/secret always
+// yields the same Credential.
+func DeriveCredential(h ScramHash, username, secret string) Credential {
+	salt := saltFor(h, username, secret)
+	saltedPassword := saltedPasswordFor(h, secret, salt, scramIterations)
+
+	clientKey := hmacSum(h, saltedPassword, []byte("Client Key"))
+	storedKey := hashSum(h, clientKey)
+	serverKey := hmacSum(h, saltedPassword, []byte("Server Key"))
+
+	return Credential{Salt: salt, Iterations: scramIterations, StoredKey: storedKey, ServerKey: serverKey}
+}
+
+func saltFor(h ScramHash, username, secret string) []byte {
+	return hmacSum(h, []byte(secret), []byte("smtp-tunnel-scram-salt:"+username))[:16]
+}
+
+func saltedPasswordFor(h ScramHash, secret string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(secret), salt, iterations, h.new()().Size(), h.new())
+}
+
+func hmacSum(h ScramHash, key, data []byte) []byte {
+	mac := hmac.New(h.new(), key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func hashSum(h ScramHash, data []byte) []byte {
+	hh := h.new()()
+	hh.Write(data)
+	return hh.Sum(nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// CredentialLookup resolves a username to its SCRAM credential, mirroring
+// the shape of a map/store lookup (e.g. users.MapAuthenticator).
+type CredentialLookup func(username string) (Credential, bool)
+
+// ServerConv drives the server side of one SCRAM exchange.
+type ServerConv struct {
+	hash            ScramHash
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	username        string
+	cred            Credential
+}
+
+// NewServerConv parses a client-first-message and returns the
+// server-first-message to send back (as "334 <base64>"), or an error if
+// the message is malformed.
+func NewServerConv(h ScramHash, clientFirstMessage string, lookup CredentialLookup) (*ServerConv, string, error) {
+	gs2Header, bare, err := splitGS2Header(clientFirstMessage)
+	if err != nil {
+		return nil, "", err
+	}
+
+	attrs, err := parseAttrs(bare)
+	if err != nil {
+		return nil, "", err
+	}
+	username, ok := attrs["n"]
+	if !ok {
+		return nil, "", fmt.Errorf("sasl: client-first missing n=")
+	}
+	username = scramUnescape(username)
+	clientNonce, ok := attrs["r"]
+	if !ok {
+		return nil, "", fmt.Errorf("sasl: client-first missing r=")
+	}
+
+	cred, ok := lookup(username)
+	if !ok {
+		// Still run a full round with a fake credential so a timing or
+		// behavior difference doesn't reveal whether the username
+		// exists; Finish() will fail for real since no client can
+		// produce a matching proof for it.
+		cred = DeriveCredential(h, username, randomNonce())
+	}
+
+	serverNonce := clientNonce + randomNonce()
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", serverNonce, base64.StdEncoding.EncodeToString(cred.Salt), cred.Iterations)
+
+	return &ServerConv{
+		hash:            h,
+		gs2Header:       gs2Header,
+		clientFirstBare: bare,
+		serverFirst:     serverFirst,
+		nonce:           serverNonce,
+		username:        username,
+		cred:            cred,
+	}, serverFirst, nil
+}
+
+// Username returns the username asserted by the client-first-message.
+func (s *ServerConv) Username() string {
+	return s.username
+}
+
+// Finish verifies the client-final-message against cbindData (the raw
+// channel-binding data, e.g. a tls-server-end-point certificate hash, or
+// nil if the client didn't request channel binding) and returns the
+// server-final-message to send back.
+func (s *ServerConv) Finish(clientFinalMessage string, cbindData []byte) (serverFinalMessage string, ok bool) {
+	attrs, err := parseAttrs(clientFinalMessage)
+	if err != nil {
+		return "", false
+	}
+	cbindInput, ok := attrs["c"]
+	if !ok {
+		return "", false
+	}
+	nonce, ok := attrs["r"]
+	if !ok || nonce != s.nonce {
+		return "", false
+	}
+	proofB64, ok := attrs["p"]
+	if !ok {
+		return "", false
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(proofB64)
+	if err != nil {
+		return "", false
+	}
+
+	expectedCbindInput := base64.StdEncoding.EncodeToString(append([]byte(s.gs2Header), cbindData...))
+	if !constantTimeEqual(cbindInput, expectedCbindInput) {
+		return "", false
+	}
+
+	withoutProof := clientFinalMessage[:strings.LastIndex(clientFinalMessage, ",p=")]
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+
+	clientSignature := hmacSum(s.hash, s.cred.StoredKey, []byte(authMessage))
+	recoveredClientKey := xorBytes(clientProof, clientSignature)
+	if !constantTimeEqualBytes(hashSum(s.hash, recoveredClientKey), s.cred.StoredKey) {
+		return "", false
+	}
+
+	serverSignature := hmacSum(s.hash, s.cred.ServerKey, []byte(authMessage))
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), true
+}
+
+// ClientConv drives the client side of one SCRAM exchange.
+type ClientConv struct {
+	hash            ScramHash
+	secret          string
+	gs2Header       string
+	clientFirstBare string
+	clientNonce     string
+	cbindData       []byte
+	authMessage     string
+	serverSignature []byte
+}
+
+// NewClientConv starts a SCRAM exchange for username/secret, binding to
+// cbindData (the channel-binding data the server is expected to present,
+// e.g. a tls-server-end-point certificate hash, or nil to negotiate
+// without channel binding). It returns the client-first-message to send
+// as "AUTH <mech> <base64>".
+func NewClientConv(h ScramHash, username, secret string, cbindData []byte) (*ClientConv, string) {
+	gs2Header := "n,,"
+	if cbindData != nil {
+		gs2Header = "p=tls-server-end-point,,"
+	}
+
+	clientNonce := randomNonce()
+	bare := fmt.Sprintf("n=%s,r=%s", scramEscape(username), clientNonce)
+
+	return &ClientConv{
+		hash:            h,
+		secret:          secret,
+		gs2Header:       gs2Header,
+		clientFirstBare: bare,
+		clientNonce:     clientNonce,
+		cbindData:       cbindData,
+	}, gs2Header + bare
+}
+
+// Finish processes the server-first-message and returns the
+// client-final-message to send back.
+func (c *ClientConv) Finish(serverFirstMessage string) (string, error) {
+	attrs, err := parseAttrs(serverFirstMessage)
+	if err != nil {
+		return "", err
+	}
+	nonce, ok := attrs["r"]
+	if !ok || !strings.HasPrefix(nonce, c.clientNonce) {
+		return "", fmt.Errorf("sasl: server nonce does not extend client nonce")
+	}
+	saltB64, ok := attrs["s"]
+	if !ok {
+		return "", fmt.Errorf("sasl: server-first missing s=")
+	}
+	salt, err := base64.StdEncoding.DecodeString(saltB64)
+	if err != nil {
+		return "", fmt.Errorf("sasl: bad salt: %w", err)
+	}
+	iterations, err := parsePositiveInt(attrs["i"])
+	if err != nil {
+		return "", fmt.Errorf("sasl: bad iteration count: %w", err)
+	}
+
+	cbindInput := append([]byte(c.gs2Header), c.cbindData...)
+	withoutProof := fmt.Sprintf("c=%s,r=%s", base64.StdEncoding.EncodeToString(cbindInput), nonce)
+	c.authMessage = c.clientFirstBare + "," + serverFirstMessage + "," + withoutProof
+
+	saltedPassword := saltedPasswordFor(c.hash, c.secret, salt, iterations)
+	clientKey := hmacSum(c.hash, saltedPassword, []byte("Client Key"))
+	storedKey := hashSum(c.hash, clientKey)
+	serverKey := hmacSum(c.hash, saltedPassword, []byte("Server Key"))
+
+	clientSignature := hmacSum(c.hash, storedKey, []byte(c.authMessage))
+	clientProof := xorBytes(clientKey, clientSignature)
+	c.serverSignature = hmacSum(c.hash, serverKey, []byte(c.authMessage))
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientProof), nil
+}
+
+// VerifyServerFinal checks the server-final-message's signature, proving
+// the server held the same credential (mutual authentication).
+func (c *ClientConv) VerifyServerFinal(serverFinalMessage string) bool {
+	attrs, err := parseAttrs(serverFinalMessage)
+	if err != nil {
+		return false
+	}
+	v, ok := attrs["v"]
+	if !ok {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return false
+	}
+	return constantTimeEqualBytes(sig, c.serverSignature)
+}
+
+func splitGS2Header(clientFirstMessage string) (header, bare string, err error) {
+	if strings.HasPrefix(clientFirstMessage, "n,,") || strings.HasPrefix(clientFirstMessage, "y,,") {
+		return clientFirstMessage[:3], clientFirstMessage[3:], nil
+	}
+	if strings.HasPrefix(clientFirstMessage, "p=") {
+		idx := strings.Index(clientFirstMessage, ",,")
+		if idx < 0 {
+			return "", "", fmt.Errorf("sasl: malformed gs2-header")
+		}
+		return clientFirstMessage[:idx+2], clientFirstMessage[idx+2:], nil
+	}
+	return "", "", fmt.Errorf("sasl: unsupported gs2-header")
+}
+
+func parseAttrs(message string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(message, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("sasl: empty SCRAM message")
+	}
+	return attrs, nil
+}
+
+func parsePositiveInt(s string) (int, error) {
+	n := 0
+	if s == "" {
+		return 0, fmt.Errorf("empty")
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("not a number: %q", s)
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, nil
+}
+
+func randomNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	return strings.ReplaceAll(s, ",", "=2C")
+}
+
+func scramUnescape(s string) string {
+	s = strings.ReplaceAll(s, "=2C", ",")
+	return strings.ReplaceAll(s, "=3D", "=")
+}
+
+func constantTimeEqual(a, b string) bool {
+	return constantTimeEqualBytes([]byte(a), []byte(b))
+}
+
+func constantTimeEqualBytes(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var v byte
+	for i := range a {
+		v |= a[i] ^ b[i]
+	}
+	return v == 0
+}
@@ -1,4 +1,6 @@
-// Package service provides install, service management, and wizard functionality.
+// Package service manages smtptunnel as an OS-native service (systemd,
+// launchd, Windows SCM, or OpenRC) via github.com/kardianos/service, which
+// picks the right backend for the current platform and init system.
 package service
 
 import (
@@ -7,22 +9,172 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+
+	kservice "github.com/kardianos/service"
+
+	"smtptunnel/internal/config"
+	"smtptunnel/internal/logging"
 )
 
-const (
+var (
 	// BinDir is the default installation directory for binaries.
-	BinDir = "/usr/local/bin"
+	BinDir = defaultBinDir()
 	// BaseDir is the root config directory.
-	BaseDir = "/etc/smtptunnel"
+	BaseDir = defaultBaseDir()
 	// ConfigsDir stores per-instance config files.
-	ConfigsDir = "/etc/smtptunnel/configs"
+	ConfigsDir = filepath.Join(BaseDir, "configs")
 	// CertsDir stores generated certificates.
-	CertsDir = "/etc/smtptunnel/certs"
-	// ServicePrefix is the systemd service name prefix.
-	ServicePrefix = "smtptunnel"
+	CertsDir = filepath.Join(BaseDir, "certs")
 )
 
+// ServicePrefix is the service name prefix used across all platforms.
+const ServicePrefix = "smtptunnel"
+
+func defaultBinDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return `C:\Program Files\smtptunnel`
+	default:
+		return "/usr/local/bin"
+	}
+}
+
+func defaultBaseDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return `C:\ProgramData\smtptunnel`
+	case "darwin":
+		return "/usr/local/etc/smtptunnel"
+	default:
+		return "/etc/smtptunnel"
+	}
+}
+
+// registryPath holds metadata for every service this tool has installed,
+// since kardianos/service models one service per kservice.Service value
+// rather than offering a cross-platform way to enumerate them.
+func registryPath() string {
+	return filepath.Join(BaseDir, "services.registry")
+}
+
+// registryEntry is one line of the registry: everything needed to rebuild
+// the kservice.Config used at install time, so Stop/Restart/Remove/List can
+// address the same OS service later.
+type registryEntry struct {
+	Name       string
+	Role       string
+	ConfigPath string
+	BinPath    string
+}
+
+func loadRegistry() ([]registryEntry, error) {
+	data, err := os.ReadFile(registryPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []registryEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			continue
+		}
+		entries = append(entries, registryEntry{Name: parts[0], Role: parts[1], ConfigPath: parts[2], BinPath: parts[3]})
+	}
+	return entries, nil
+}
+
+func saveRegistry(entries []registryEntry) error {
+	var sb strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&sb, "%s|%s|%s|%s\n", e.Name, e.Role, e.ConfigPath, e.BinPath)
+	}
+	return os.WriteFile(registryPath(), []byte(sb.String()), 0644)
+}
+
+func putRegistryEntry(e registryEntry) error {
+	entries, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+	for i, existing := range entries {
+		if existing.Name == e.Name {
+			entries[i] = e
+			return saveRegistry(entries)
+		}
+	}
+	return saveRegistry(append(entries, e))
+}
+
+func takeRegistryEntry(name string) (registryEntry, error) {
+	entries, err := loadRegistry()
+	if err != nil {
+		return registryEntry{}, err
+	}
+	out := entries[:0]
+	var found *registryEntry
+	for _, e := range entries {
+		if e.Name == name {
+			ec := e
+			found = &ec
+			continue
+		}
+		out = append(out, e)
+	}
+	if found == nil {
+		return registryEntry{}, fmt.Errorf("service %q not registered", name)
+	}
+	return *found, saveRegistry(out)
+}
+
+func findRegistryEntry(name string) (registryEntry, error) {
+	entries, err := loadRegistry()
+	if err != nil {
+		return registryEntry{}, err
+	}
+	for _, e := range entries {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+	return registryEntry{}, fmt.Errorf("service %q not registered", name)
+}
+
+// program is the kservice.Interface smtptunnel registers with the service
+// manager. Start/Stop are never actually invoked in practice: the installed
+// service's Arguments point directly at "run -c <config>", so the OS
+// service manager runs the real foreground loop itself instead of
+// dispatching through this process. program exists only to satisfy
+// kservice.New's signature.
+type program struct{}
+
+func (program) Start(kservice.Service) error { return nil }
+func (program) Stop(kservice.Service) error  { return nil }
+
+func newService(serviceName, binPath, configPath, role string) (kservice.Service, error) {
+	desc := "SMTP Tunnel Server"
+	if role == "client" {
+		desc = "SMTP Tunnel Client"
+	}
+
+	cfg := &kservice.Config{
+		Name:        serviceName,
+		DisplayName: fmt.Sprintf("%s (%s)", desc, serviceName),
+		Description: desc,
+		Executable:  binPath,
+		Arguments:   []string{"run", "-c", configPath},
+	}
+	return kservice.New(program{}, cfg)
+}
+
 // EnsureDirectories creates all required directories.
 func EnsureDirectories() error {
 	dirs := []string{BaseDir, ConfigsDir, CertsDir}
@@ -34,7 +186,15 @@ func EnsureDirectories() error {
 	return nil
 }
 
-// InstallBinary copies the currently running binary to /usr/local/bin/<name>.
+// execName appends the platform's executable suffix, if any.
+func execName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// InstallBinary copies the currently running binary to BinDir/<name>.
 func InstallBinary(name string) error {
 	src, err := os.Executable()
 	if err != nil {
@@ -45,7 +205,10 @@ func InstallBinary(name string) error {
 		return fmt.Errorf("resolve symlink: %w", err)
 	}
 
-	dst := filepath.Join(BinDir, name)
+	if err := os.MkdirAll(BinDir, 0755); err != nil {
+		return fmt.Errorf("create %s: %w", BinDir, err)
+	}
+	dst := filepath.Join(BinDir, execName(name))
 
 	// Don't copy if already in place
 	if src == dst {
@@ -60,7 +223,7 @@ func InstallBinary(name string) error {
 	return nil
 }
 
-// Install registers a config file as a systemd service.
+// Install registers a config file as an OS service and starts it.
 func Install(configFile, binaryName string) error {
 	if err := EnsureDirectories(); err != nil {
 		return err
@@ -74,39 +237,64 @@ func Install(configFile, binaryName string) error {
 	// Copy config file
 	dstConfig := filepath.Join(ConfigsDir, base)
 	if err := copyFile(configFile, dstConfig, 0644); err != nil {
+		auditService(configFile, "service_install", serviceName, err)
 		return fmt.Errorf("copy config: %w", err)
 	}
 	fmt.Printf("Config copied to %s\n", dstConfig)
 
-	// Generate systemd unit
-	binPath := filepath.Join(BinDir, fmt.Sprintf("%s-%s", ServicePrefix, binaryName))
-	unit := generateUnit(serviceName, binPath, dstConfig, binaryName)
+	binPath := filepath.Join(BinDir, execName(fmt.Sprintf("%s-%s", ServicePrefix, binaryName)))
+	svc, err := newService(serviceName, binPath, dstConfig, binaryName)
+	if err != nil {
+		auditService(configFile, "service_install", serviceName, err)
+		return fmt.Errorf("create service: %w", err)
+	}
+	if err := svc.Install(); err != nil {
+		auditService(configFile, "service_install", serviceName, err)
+		return fmt.Errorf("install service: %w", err)
+	}
+	if err := putRegistryEntry(registryEntry{Name: serviceName, Role: binaryName, ConfigPath: dstConfig, BinPath: binPath}); err != nil {
+		auditService(configFile, "service_install", serviceName, err)
+		return fmt.Errorf("record service: %w", err)
+	}
 
-	unitPath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
-	if err := os.WriteFile(unitPath, []byte(unit), 0644); err != nil {
-		return fmt.Errorf("write service file: %w", err)
+	if err := svc.Start(); err != nil {
+		auditService(configFile, "service_install", serviceName, err)
+		return fmt.Errorf("start service: %w", err)
 	}
-	fmt.Printf("Service file written to %s\n", unitPath)
+	auditService(configFile, "service_install", serviceName, nil)
+	fmt.Printf("Service %s installed and started\n", serviceName)
+	return nil
+}
 
-	// Reload and enable
-	if err := systemctl("daemon-reload"); err != nil {
-		return err
+// auditService best-effort loads configFile for its [server.audit] settings
+// and emits a service_install/service_remove event, so installs and removals
+// show up in the same structured audit stream as per-connection events even
+// though this runs as a one-shot CLI command rather than the long-running
+// server. A config that can't be loaded, or has audit disabled (true for
+// every client config, which has no [server.audit] section at all), simply
+// means no event is emitted - Install/Remove's own return value is what
+// actually matters to the caller.
+func auditService(configFile, event, serviceName string, cause error) {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return
 	}
-	if err := systemctl("enable", "--now", serviceName); err != nil {
-		return err
+	auditor := logging.NewAuditor(cfg.Server.Audit)
+	if auditor == nil {
+		return
 	}
-	fmt.Printf("Service %s enabled and started\n", serviceName)
-	return nil
+	defer auditor.Close()
+	auditor.Service(event, serviceName, cause)
 }
 
-// List lists all smtptunnel systemd services.
+// List lists all smtptunnel services this tool has installed.
 func List() error {
-	files, err := filepath.Glob("/etc/systemd/system/smtptunnel-*.service")
+	entries, err := loadRegistry()
 	if err != nil {
 		return err
 	}
 
-	if len(files) == 0 {
+	if len(entries) == 0 {
 		fmt.Println("No smtptunnel services registered.")
 		return nil
 	}
@@ -114,47 +302,99 @@ func List() error {
 	fmt.Printf("%-40s  %-10s\n", "SERVICE", "STATUS")
 	fmt.Println(strings.Repeat("-", 55))
 
-	for _, f := range files {
-		name := strings.TrimSuffix(filepath.Base(f), ".service")
-		status := getServiceStatus(name)
-		fmt.Printf("%-40s  %-10s\n", name, status)
+	for _, e := range entries {
+		status := "unknown"
+		if svc, err := newService(e.Name, e.BinPath, e.ConfigPath, e.Role); err == nil {
+			status = statusString(svc)
+		}
+		fmt.Printf("%-40s  %-10s\n", e.Name, status)
 	}
 	return nil
 }
 
-// Remove stops, disables, and removes a service.
+func statusString(svc kservice.Service) string {
+	st, err := svc.Status()
+	if err != nil {
+		return "unknown"
+	}
+	switch st {
+	case kservice.StatusRunning:
+		return "running"
+	case kservice.StatusStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Remove stops, uninstalls, and forgets a service.
 func Remove(name string) error {
 	serviceName := resolveServiceName(name)
+	entry, err := findRegistryEntry(serviceName)
+	if err != nil {
+		return err
+	}
 
-	_ = systemctl("stop", serviceName)
-	_ = systemctl("disable", serviceName)
-
-	unitPath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
-	if err := os.Remove(unitPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("remove service file: %w", err)
+	svc, err := newService(entry.Name, entry.BinPath, entry.ConfigPath, entry.Role)
+	if err != nil {
+		auditService(entry.ConfigPath, "service_remove", serviceName, err)
+		return fmt.Errorf("create service: %w", err)
+	}
+	_ = svc.Stop()
+	if err := svc.Uninstall(); err != nil {
+		auditService(entry.ConfigPath, "service_remove", serviceName, err)
+		return fmt.Errorf("uninstall service: %w", err)
+	}
+	if _, err := takeRegistryEntry(serviceName); err != nil {
+		auditService(entry.ConfigPath, "service_remove", serviceName, err)
+		return err
 	}
 
-	_ = systemctl("daemon-reload")
+	auditService(entry.ConfigPath, "service_remove", serviceName, nil)
 	fmt.Printf("Service %s removed\n", serviceName)
 	return nil
 }
 
-// Logs shows journal logs for a service.
+// Logs shows recent logs for a service. Full log retrieval is only
+// implemented where the platform exposes a simple CLI for it (journalctl on
+// Linux); elsewhere this points the user at the platform's own log viewer,
+// since kardianos/service doesn't standardize log access across backends.
 func Logs(name string, lines int) error {
 	serviceName := resolveServiceName(name)
 	if lines <= 0 {
 		lines = 50
 	}
-	cmd := exec.Command("journalctl", "-u", serviceName, "-n", fmt.Sprintf("%d", lines), "--no-pager")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+
+	switch runtime.GOOS {
+	case "linux":
+		cmd := exec.Command("journalctl", "-u", serviceName, "-n", fmt.Sprintf("%d", lines), "--no-pager")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	case "darwin":
+		fmt.Printf("View logs with: log show --predicate 'process == \"%s\"' --last 1h\n", serviceName)
+		return nil
+	case "windows":
+		fmt.Printf("View logs in Event Viewer under Windows Logs > Application, source %q\n", serviceName)
+		return nil
+	default:
+		return fmt.Errorf("log retrieval is not supported on %s", runtime.GOOS)
+	}
 }
 
 // Stop stops a service.
 func Stop(name string) error {
 	serviceName := resolveServiceName(name)
-	if err := systemctl("stop", serviceName); err != nil {
+	entry, err := findRegistryEntry(serviceName)
+	if err != nil {
+		return err
+	}
+
+	svc, err := newService(entry.Name, entry.BinPath, entry.ConfigPath, entry.Role)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	if err := svc.Stop(); err != nil {
 		return err
 	}
 	fmt.Printf("Service %s stopped\n", serviceName)
@@ -164,7 +404,16 @@ func Stop(name string) error {
 // Restart restarts a service.
 func Restart(name string) error {
 	serviceName := resolveServiceName(name)
-	if err := systemctl("restart", serviceName); err != nil {
+	entry, err := findRegistryEntry(serviceName)
+	if err != nil {
+		return err
+	}
+
+	svc, err := newService(entry.Name, entry.BinPath, entry.ConfigPath, entry.Role)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	if err := svc.Restart(); err != nil {
 		return err
 	}
 	fmt.Printf("Service %s restarted\n", serviceName)
@@ -178,50 +427,6 @@ func resolveServiceName(name string) string {
 	return fmt.Sprintf("%s-%s", ServicePrefix, name)
 }
 
-func generateUnit(serviceName, binPath, configPath, role string) string {
-	desc := "SMTP Tunnel Server"
-	if role == "client" {
-		desc = "SMTP Tunnel Client"
-	}
-
-	extra := ""
-	if role == "server" {
-		extra = "LimitNOFILE=65535\n"
-	}
-
-	return fmt.Sprintf(`[Unit]
-Description=%s (%s)
-After=network-online.target
-Wants=network-online.target
-
-[Service]
-Type=simple
-ExecStart=%s run -c %s
-Restart=on-failure
-RestartSec=5
-%sStandardOutput=journal
-StandardError=journal
-
-[Install]
-WantedBy=multi-user.target
-`, desc, serviceName, binPath, configPath, extra)
-}
-
-func getServiceStatus(name string) string {
-	out, err := exec.Command("systemctl", "is-active", name).CombinedOutput()
-	if err != nil {
-		return "inactive"
-	}
-	return strings.TrimSpace(string(out))
-}
-
-func systemctl(args ...string) error {
-	cmd := exec.Command("systemctl", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 func copyFile(src, dst string, perm os.FileMode) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -3,7 +3,12 @@ package smtp
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -11,13 +16,19 @@ import (
 	"time"
 
 	"smtptunnel/internal/crypto"
+	"smtptunnel/internal/sasl"
+	"smtptunnel/internal/users"
 )
 
 const readTimeout = 60 * time.Second
 
-// ServerHandshake performs the server-side SMTP handshake over a raw TCP connection.
-// Returns the authenticated username, the upgraded TLS connection, or an error.
-func ServerHandshake(conn net.Conn, hostname string, tlsConfig *tls.Config, users map[string]string) (string, net.Conn, error) {
+// ServerHandshake performs the server-side SMTP handshake over a raw TCP
+// connection, impersonating the given Profile (greeting, capability lines,
+// response text, and timing) so the exchange fingerprints as that MTA.
+// Returns the authenticated username, whether the client signaled this is a
+// reconnect (see ClientHandshake's resume parameter), the upgraded TLS
+// connection, or an error.
+func ServerHandshake(conn net.Conn, hostname string, tlsConfig *tls.Config, auth users.Authenticator, profile Profile) (string, bool, net.Conn, error) {
 	r := bufio.NewReader(conn)
 
 	writeLine := func(line string) error {
@@ -36,40 +47,38 @@ func ServerHandshake(conn net.Conn, hostname string, tlsConfig *tls.Config, user
 	}
 
 	// 220 greeting
-	if err := writeLine(fmt.Sprintf("220 %s ESMTP Postfix (Ubuntu)", hostname)); err != nil {
-		return "", nil, err
+	if err := writeLine(profile.Greeting(hostname)); err != nil {
+		return "", false, nil, err
 	}
 
 	// EHLO
 	line, err := readLine()
 	if err != nil {
-		return "", nil, err
+		return "", false, nil, err
 	}
 	upper := strings.ToUpper(line)
 	if !strings.HasPrefix(upper, "EHLO") && !strings.HasPrefix(upper, "HELO") {
-		return "", nil, fmt.Errorf("expected EHLO, got: %s", line)
+		return "", false, nil, fmt.Errorf("expected EHLO, got: %s", line)
 	}
 
-	// Capabilities
-	writeLine(fmt.Sprintf("250-%s", hostname))
-	writeLine("250-STARTTLS")
-	writeLine("250-AUTH PLAIN LOGIN")
-	writeLine("250 8BITMIME")
+	// Capabilities. Real MTAs only advertise their AUTH mechanism list after
+	// STARTTLS, so the profile's pre-TLS capabilities never include it.
+	writeCaps(writeLine, hostname, profile.PreTLSCaps, profile.CommandDelay)
 
 	// STARTTLS
 	line, err = readLine()
 	if err != nil {
-		return "", nil, err
+		return "", false, nil, err
 	}
 	if strings.ToUpper(line) != "STARTTLS" {
-		return "", nil, fmt.Errorf("expected STARTTLS, got: %s", line)
+		return "", false, nil, fmt.Errorf("expected STARTTLS, got: %s", line)
 	}
-	writeLine("220 2.0.0 Ready to start TLS")
+	writeLine(profile.StartTLSReady)
 
 	// Upgrade to TLS
 	tlsConn := tls.Server(conn, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
-		return "", nil, fmt.Errorf("tls handshake: %w", err)
+		return "", false, nil, fmt.Errorf("tls handshake: %w", err)
 	}
 
 	// Re-wrap with buffered reader on TLS conn
@@ -94,60 +103,314 @@ func ServerHandshake(conn net.Conn, hostname string, tlsConfig *tls.Config, user
 	// EHLO again
 	line, err = readLine()
 	if err != nil {
-		return "", nil, err
+		return "", false, nil, err
 	}
 	upper = strings.ToUpper(line)
 	if !strings.HasPrefix(upper, "EHLO") && !strings.HasPrefix(upper, "HELO") {
-		return "", nil, fmt.Errorf("expected EHLO after TLS, got: %s", line)
+		return "", false, nil, fmt.Errorf("expected EHLO after TLS, got: %s", line)
 	}
 
-	writeLine(fmt.Sprintf("250-%s", hostname))
-	writeLine("250-AUTH PLAIN LOGIN")
-	writeLine("250 8BITMIME")
+	mechs := []string{}
+	scramAuth, hasScram := auth.(users.ScramAuthenticator)
+	if hasScram {
+		mechs = append(mechs, sasl.ScramSHA256.Name(), sasl.ScramSHA1.Name())
+	}
+	extAuth, hasExternal := auth.(users.ExternalAuthenticator)
+	if hasExternal && len(tlsConn.ConnectionState().PeerCertificates) > 0 {
+		mechs = append(mechs, "EXTERNAL")
+	}
+	mechs = append(mechs, "PLAIN", "LOGIN")
+	authLine := fmt.Sprintf("AUTH %s", strings.Join(mechs, " "))
+	writeCaps(writeLine, hostname, resolveAuthCap(profile.PostTLSCaps, authLine), profile.CommandDelay)
 
 	// AUTH
 	line, err = readLine()
 	if err != nil {
-		return "", nil, err
+		return "", false, nil, err
 	}
 	if !strings.HasPrefix(strings.ToUpper(line), "AUTH") {
-		return "", nil, fmt.Errorf("expected AUTH, got: %s", line)
+		return "", false, nil, fmt.Errorf("expected AUTH, got: %s", line)
 	}
 
-	parts := strings.SplitN(line, " ", 3)
-	if len(parts) < 3 {
-		writeLine("535 5.7.8 Authentication failed")
-		return "", nil, fmt.Errorf("malformed AUTH")
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 {
+		writeLine("501 5.5.4 Malformed AUTH command")
+		return "", false, nil, fmt.Errorf("malformed AUTH")
+	}
+	var initial string
+	if len(fields) == 3 {
+		initial = fields[2]
 	}
 
-	token := parts[2]
-	valid, username := crypto.VerifyAuthToken(token, users, 300)
-	if !valid {
-		writeLine("535 5.7.8 Authentication failed")
-		return "", nil, fmt.Errorf("auth failed for token")
+	var username string
+	switch strings.ToUpper(fields[1]) {
+	case sasl.ScramSHA256.Name(), sasl.ScramSHA1.Name():
+		if !hasScram {
+			writeLine("504 5.5.4 Mechanism not supported")
+			return "", false, nil, fmt.Errorf("SCRAM not supported by this authenticator")
+		}
+		h := sasl.ScramSHA256
+		if strings.ToUpper(fields[1]) == sasl.ScramSHA1.Name() {
+			h = sasl.ScramSHA1
+		}
+		username, err = serverScramAuth(h, scramAuth, tlsConfig, initial, writeLine, readLine)
+	case "EXTERNAL":
+		if !hasExternal {
+			writeLine("504 5.5.4 Mechanism not supported")
+			return "", false, nil, fmt.Errorf("EXTERNAL not supported by this authenticator")
+		}
+		username, err = serverExternalAuth(auth, extAuth, tlsConn, initial, writeLine, readLine)
+	default:
+		// Legacy PLAIN/LOGIN: a single raw token in fields[2], regardless of
+		// the mechanism name (neither is real SASL PLAIN/LOGIN encoding).
+		token := initial
+		if token == "" {
+			if werr := writeLine("334 "); werr != nil {
+				return "", false, nil, werr
+			}
+			token, err = readLine()
+		}
+		if err == nil {
+			var valid bool
+			valid, username = auth.Verify(token)
+			if !valid {
+				err = fmt.Errorf("auth failed for token")
+			}
+		}
+	}
+	if err != nil {
+		writeLine(profile.AuthFailure)
+		return "", false, nil, fmt.Errorf("auth failed: %w", err)
 	}
 
-	writeLine("235 2.7.0 Authentication successful")
+	writeLine(profile.AuthSuccess)
 
-	// BINARY mode signal
+	// BINARY mode signal. A client reconnecting after a dropped session
+	// sends "BINARY RESUME" instead of "BINARY" so the server knows to tear
+	// down any session it still has registered for this user (see
+	// tunnel.Server.sessions) rather than running both side by side.
 	line, err = readLine()
 	if err != nil {
-		return "", nil, err
+		return "", false, nil, err
 	}
-	if line != "BINARY" {
-		return "", nil, fmt.Errorf("expected BINARY, got: %s", line)
+	var resume bool
+	switch line {
+	case "BINARY":
+	case "BINARY RESUME":
+		resume = true
+	default:
+		return "", false, nil, fmt.Errorf("expected BINARY, got: %s", line)
 	}
 	writeLine("299 Binary mode activated")
 
 	// Clear deadlines for streaming
 	conn.SetDeadline(time.Time{})
 
-	return username, conn, nil
+	return username, resume, conn, nil
+}
+
+// writeCaps emits a multiline EHLO response: a "250-<hostname>" line followed
+// by caps in order, each "250-" except the last which is "250 ". delay, if
+// nonzero, is slept before each capability line (not the hostname line) to
+// mimic the profile's own latency.
+func writeCaps(writeLine func(string) error, hostname string, caps []string, delay time.Duration) {
+	writeLine(fmt.Sprintf("250-%s", hostname))
+	for i, c := range caps {
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		if i == len(caps)-1 {
+			writeLine(fmt.Sprintf("250 %s", c))
+		} else {
+			writeLine(fmt.Sprintf("250-%s", c))
+		}
+	}
+}
+
+// resolveAuthCap substitutes authCapSentinel in caps with the computed AUTH
+// capability line.
+func resolveAuthCap(caps []string, authLine string) []string {
+	out := make([]string, len(caps))
+	for i, c := range caps {
+		if c == authCapSentinel {
+			out[i] = authLine
+		} else {
+			out[i] = c
+		}
+	}
+	return out
+}
+
+// serverScramAuth drives the server side of a SCRAM-SHA-256/SCRAM-SHA-1
+// exchange (RFC 5802/7677) over the AUTH continuation channel and returns the
+// authenticated username.
+func serverScramAuth(h sasl.ScramHash, scramAuth users.ScramAuthenticator, tlsConfig *tls.Config, initial string, writeLine func(string) error, readLine func() (string, error)) (string, error) {
+	clientFirstB64 := initial
+	if clientFirstB64 == "" {
+		if err := writeLine("334 "); err != nil {
+			return "", err
+		}
+		line, err := readLine()
+		if err != nil {
+			return "", err
+		}
+		clientFirstB64 = line
+	}
+	clientFirst, err := decodeSaslB64(clientFirstB64)
+	if err != nil {
+		return "", err
+	}
+
+	conv, serverFirst, err := sasl.NewServerConv(h, clientFirst, func(username string) (sasl.Credential, bool) {
+		return scramAuth.ScramCredential(h, username)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := writeLine("334 " + encodeSaslB64(serverFirst)); err != nil {
+		return "", err
+	}
+
+	clientFinalB64, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	clientFinal, err := decodeSaslB64(clientFinalB64)
+	if err != nil {
+		return "", err
+	}
+
+	serverFinal, ok := conv.Finish(clientFinal, serverChannelBindingData(tlsConfig))
+	if !ok {
+		return "", fmt.Errorf("SCRAM verification failed")
+	}
+	if err := writeLine("334 " + encodeSaslB64(serverFinal)); err != nil {
+		return "", err
+	}
+
+	// RFC 4954: the client must ack the final additional data with one more
+	// (empty) continuation line before the server concludes with 235.
+	if _, err := readLine(); err != nil {
+		return "", err
+	}
+	return conv.Username(), nil
+}
+
+// serverExternalAuth drives AUTH EXTERNAL: the authzid carried in the
+// continuation is ignored, since identity comes entirely from the TLS client
+// certificate already presented during the handshake. If auth also
+// implements users.FingerprintAuthenticator, the certificate's SHA-256
+// fingerprint is checked first and, on a match, is authoritative over the
+// certificate's CommonName; this is what lets an mTLS-provisioned
+// certificate (see internal/pki) authenticate a session on its own,
+// bypassing the HMAC AuthToken scheme entirely.
+func serverExternalAuth(auth users.Authenticator, extAuth users.ExternalAuthenticator, tlsConn *tls.Conn, initial string, writeLine func(string) error, readLine func() (string, error)) (string, error) {
+	if initial == "" {
+		if err := writeLine("334 "); err != nil {
+			return "", err
+		}
+		line, err := readLine()
+		if err != nil {
+			return "", err
+		}
+		initial = line
+	}
+	if _, err := decodeSaslB64(initial); err != nil {
+		return "", err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("EXTERNAL requires a TLS client certificate")
+	}
+
+	if fpAuth, ok := auth.(users.FingerprintAuthenticator); ok {
+		if valid, username := fpAuth.VerifyFingerprint(certFingerprint(certs[0])); valid {
+			return username, nil
+		}
+	}
+
+	cn := certs[0].Subject.CommonName
+	if !extAuth.VerifyExternal(cn) {
+		return "", fmt.Errorf("unknown EXTERNAL identity %q", cn)
+	}
+	return cn, nil
+}
+
+// certFingerprint returns the lowercase hex SHA-256 fingerprint of cert's
+// DER bytes, matching config.UserEntry.ClientCertFingerprint.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// serverChannelBindingData returns the tls-server-end-point channel-binding
+// value (RFC 5929) for the certificate the server presents: a hash of its DER
+// bytes, using the same hash algorithm as the certificate's own signature
+// (SHA-256 by default, SHA-384/SHA-512 for certs signed with those). It
+// returns nil when the server's leaf certificate can't be determined (e.g. an
+// ACME config that supplies certificates via GetCertificate rather than the
+// static Certificates list); a client that bound to the certificate it saw
+// then fails SCRAM verification, since its channel-binding data can't match.
+func serverChannelBindingData(tlsConfig *tls.Config) []byte {
+	if len(tlsConfig.Certificates) == 0 || len(tlsConfig.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return tlsServerEndPointHash(cert)
+}
+
+// tlsServerEndPointHash implements the tls-server-end-point channel-binding
+// hash from RFC 5929 section 4.1.
+func tlsServerEndPointHash(cert *x509.Certificate) []byte {
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		sum := sha512.Sum384(cert.Raw)
+		return sum[:]
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		sum := sha512.Sum512(cert.Raw)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(cert.Raw)
+		return sum[:]
+	}
+}
+
+// decodeSaslB64 decodes a base64 SASL continuation payload; a lone "="
+// denotes an empty response per RFC 4954.
+func decodeSaslB64(s string) (string, error) {
+	if s == "=" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("bad base64 in AUTH continuation: %w", err)
+	}
+	return string(b), nil
+}
+
+func encodeSaslB64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
 }
 
 // ClientHandshake performs the client-side SMTP handshake.
-// Returns the upgraded TLS connection or an error.
-func ClientHandshake(conn net.Conn, serverHost, username, secret string, tlsConfig *tls.Config) (net.Conn, error) {
+// authMode selects the AUTH mechanism: "password" sends the shared secret
+// directly as a legacy AUTH PLAIN token (for servers backed by
+// users.FileAuthenticator, which can only verify against a one-way hash);
+// "scram" runs a real SCRAM-SHA-256 exchange (RFC 5802) with tls-server-
+// end-point channel binding, which requires a users.ScramAuthenticator on the
+// server side; "external" sends AUTH EXTERNAL and authenticates purely by
+// the TLS client certificate configured via Client.CertFile/KeyFile (see
+// internal/pki), without ever sending secret or username material; anything
+// else (including "") uses the default HMAC-signed legacy AUTH PLAIN token.
+// resume signals the server that this connection is replacing a previous
+// session for the same user (see ServerHandshake), so a session the server
+// still considers alive is torn down instead of running alongside the new
+// one. Returns the upgraded TLS connection or an error.
+func ClientHandshake(conn net.Conn, serverHost, username, secret, authMode string, tlsConfig *tls.Config, resume bool) (net.Conn, error) {
 	r := bufio.NewReader(conn)
 
 	writeLine := func(line string) error {
@@ -273,17 +536,38 @@ func ClientHandshake(conn net.Conn, serverHost, username, secret string, tlsConf
 	}
 
 	// AUTH
-	timestamp := time.Now().Unix()
-	token := crypto.GenerateAuthToken(secret, username, timestamp)
-	if err := writeLine(fmt.Sprintf("AUTH PLAIN %s", token)); err != nil {
-		return nil, err
-	}
-	if err := expect("235"); err != nil {
-		return nil, fmt.Errorf("auth: %w", err)
+	if authMode == "scram" {
+		if err := clientScramAuth(tlsConn, username, secret, writeLine, readLine, expect); err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	} else if authMode == "external" {
+		if err := writeLine("AUTH EXTERNAL ="); err != nil {
+			return nil, err
+		}
+		if err := expect("235"); err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	} else {
+		var token string
+		if authMode == "password" {
+			token = crypto.GeneratePasswordToken(username, secret)
+		} else {
+			token = crypto.GenerateAuthToken(secret, username, time.Now().Unix())
+		}
+		if err := writeLine(fmt.Sprintf("AUTH PLAIN %s", token)); err != nil {
+			return nil, err
+		}
+		if err := expect("235"); err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
 	}
 
 	// Switch to binary
-	if err := writeLine("BINARY"); err != nil {
+	binaryCmd := "BINARY"
+	if resume {
+		binaryCmd = "BINARY RESUME"
+	}
+	if err := writeLine(binaryCmd); err != nil {
 		return nil, err
 	}
 	if err := expect("299"); err != nil {
@@ -296,6 +580,85 @@ func ClientHandshake(conn net.Conn, serverHost, username, secret string, tlsConf
 	return conn, nil
 }
 
+// clientScramAuth drives the client side of a SCRAM-SHA-256 exchange (RFC
+// 5802) over the AUTH continuation channel, with tls-server-end-point
+// channel binding against the server's certificate.
+func clientScramAuth(tlsConn *tls.Conn, username, secret string, writeLine func(string) error, readLine func() (string, error), expect func(string) error) error {
+	cbindData := clientChannelBindingData(tlsConn)
+	conv, clientFirst := sasl.NewClientConv(sasl.ScramSHA256, username, secret, cbindData)
+
+	if err := writeLine(fmt.Sprintf("AUTH %s %s", sasl.ScramSHA256.Name(), encodeSaslB64(clientFirst))); err != nil {
+		return err
+	}
+
+	line, err := readLine()
+	if err != nil {
+		return err
+	}
+	serverFirstB64, err := parseContinuation(line)
+	if err != nil {
+		return err
+	}
+	serverFirst, err := decodeSaslB64(serverFirstB64)
+	if err != nil {
+		return err
+	}
+
+	clientFinal, err := conv.Finish(serverFirst)
+	if err != nil {
+		return err
+	}
+	if err := writeLine(encodeSaslB64(clientFinal)); err != nil {
+		return err
+	}
+
+	line, err = readLine()
+	if err != nil {
+		return err
+	}
+	serverFinalB64, err := parseContinuation(line)
+	if err != nil {
+		return err
+	}
+	serverFinal, err := decodeSaslB64(serverFinalB64)
+	if err != nil {
+		return err
+	}
+	if !conv.VerifyServerFinal(serverFinal) {
+		return fmt.Errorf("server-final signature mismatch (possible impersonation)")
+	}
+
+	// Ack the server-final continuation with an empty response, then expect
+	// the closing 235.
+	if err := writeLine("="); err != nil {
+		return err
+	}
+	return expect("235")
+}
+
+// clientChannelBindingData returns the tls-server-end-point channel-binding
+// value (RFC 5929) for the server's certificate, as seen from the client.
+func clientChannelBindingData(tlsConn *tls.Conn) []byte {
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return tlsServerEndPointHash(certs[0])
+}
+
+// parseContinuation extracts the base64 payload from a "334 <payload>" AUTH
+// continuation line.
+func parseContinuation(line string) (string, error) {
+	if !strings.HasPrefix(line, "334") {
+		return "", fmt.Errorf("expected 334 continuation, got: %s", line)
+	}
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) < 2 {
+		return "", nil
+	}
+	return parts[1], nil
+}
+
 // HostFromAddr extracts just the hostname from a host:port address.
 func HostFromAddr(addr string) string {
 	host, _, err := net.SplitHostPort(addr)
@@ -0,0 +1,244 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"smtptunnel/internal/users"
+)
+
+// bannerFixture is a parsed testdata/<profile>.txt file: a small corpus of
+// captured real-MTA banner/capability transcripts, used to check that
+// ServerHandshake's rendering of a Profile hasn't drifted from the real
+// software it claims to impersonate.
+type bannerFixture struct {
+	greeting      string // template with {host}/{date} tokens
+	pre           []string
+	startTLSReady string
+	post          []string
+	authSuccess   string
+	authFailure   string
+}
+
+func loadBannerFixture(t *testing.T, name string) bannerFixture {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name+".txt"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	var f bannerFixture
+	var section *[]string
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "GREETING "):
+			f.greeting = strings.TrimPrefix(line, "GREETING ")
+		case line == "PRE":
+			section = &f.pre
+		case strings.HasPrefix(line, "STARTTLS_READY "):
+			section = nil
+			f.startTLSReady = strings.TrimPrefix(line, "STARTTLS_READY ")
+		case line == "POST":
+			section = &f.post
+		case strings.HasPrefix(line, "AUTH_SUCCESS "):
+			section = nil
+			f.authSuccess = strings.TrimPrefix(line, "AUTH_SUCCESS ")
+		case strings.HasPrefix(line, "AUTH_FAILURE "):
+			section = nil
+			f.authFailure = strings.TrimPrefix(line, "AUTH_FAILURE ")
+		case section != nil:
+			*section = append(*section, line)
+		}
+	}
+	return f
+}
+
+// greetingPattern turns a fixture's {host}/{date} template into a regexp
+// matching whatever ServerHandshake actually sent, since the Exim/Sendmail/
+// Exchange profiles stamp the greeting with the current time.
+func greetingPattern(tmpl, host string) *regexp.Regexp {
+	const dateRe = `[A-Za-z]{3}, \d{2} [A-Za-z]{3} \d{4} \d{2}:\d{2}:\d{2} [+-]\d{4}`
+	const hostTok, dateTok = "\x00HOST\x00", "\x00DATE\x00"
+	tmpl = strings.NewReplacer("{host}", hostTok, "{date}", dateTok).Replace(tmpl)
+	tmpl = regexp.QuoteMeta(tmpl)
+	tmpl = strings.NewReplacer(hostTok, regexp.QuoteMeta(host), dateTok, dateRe).Replace(tmpl)
+	return regexp.MustCompile("^" + tmpl + "$")
+}
+
+// generateTestServerCert creates an ephemeral self-signed leaf certificate,
+// just enough for ServerHandshake's STARTTLS upgrade; the test client skips
+// verification, so no CA is needed.
+func generateTestServerCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatalf("generate serial: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "smtptunnel-test"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// readLines reads from r up to and including the first "250 " line,
+// returning every line read. Matches the "250-"/"250 " terminator convention
+// writeCaps uses for multiline EHLO responses.
+func readLines(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read line: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "250 ") {
+			return lines
+		}
+	}
+}
+
+// TestServerHandshakeProfileParity drives ServerHandshake for each built-in
+// Profile against a captured real-MTA banner/capability corpus (see
+// testdata/), so an accidental edit to profile.go's literal strings shows up
+// as a test failure instead of silently breaking the cover story's
+// fingerprint parity.
+func TestServerHandshakeProfileParity(t *testing.T) {
+	const host = "mail.example.com"
+	cert := generateTestServerCert(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	auth := users.NewMapAuthenticator(nil)
+
+	profilesByFixture := map[string]Profile{
+		"postfix-ubuntu": PostfixUbuntu,
+		"postfix-debian": PostfixDebian,
+		"exim":           EximDefault,
+		"sendmail":       SendmailDefault,
+		"exchange-o365":  ExchangeO365,
+	}
+
+	for fixtureName, profile := range profilesByFixture {
+		fixtureName, profile := fixtureName, profile
+		t.Run(profile.Name, func(t *testing.T) {
+			fixture := loadBannerFixture(t, fixtureName)
+
+			serverConn, clientConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				ServerHandshake(serverConn, host, tlsConfig, auth, profile)
+			}()
+			defer func() {
+				clientConn.Close()
+				<-done
+			}()
+
+			r := bufio.NewReader(clientConn)
+
+			greeting, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read greeting: %v", err)
+			}
+			greeting = strings.TrimRight(greeting, "\r\n")
+			if pat := greetingPattern(fixture.greeting, host); !pat.MatchString(greeting) {
+				t.Errorf("greeting %q does not match captured pattern %q", greeting, pat.String())
+			}
+
+			if _, err := fmt.Fprintf(clientConn, "EHLO tunnel-client.local\r\n"); err != nil {
+				t.Fatalf("write EHLO: %v", err)
+			}
+			preLines := readLines(t, r)
+			if got := stripCapLines(preLines, host); !equalStrings(got, fixture.pre) {
+				t.Errorf("pre-TLS caps = %v, want %v", got, fixture.pre)
+			}
+
+			if _, err := fmt.Fprintf(clientConn, "STARTTLS\r\n"); err != nil {
+				t.Fatalf("write STARTTLS: %v", err)
+			}
+			starttls, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read STARTTLS response: %v", err)
+			}
+			starttls = strings.TrimRight(starttls, "\r\n")
+			if starttls != fixture.startTLSReady {
+				t.Errorf("STARTTLS response = %q, want %q", starttls, fixture.startTLSReady)
+			}
+
+			tlsClientConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+			if err := tlsClientConn.Handshake(); err != nil {
+				t.Fatalf("tls handshake: %v", err)
+			}
+			r = bufio.NewReader(tlsClientConn)
+
+			if _, err := fmt.Fprintf(tlsClientConn, "EHLO tunnel-client.local\r\n"); err != nil {
+				t.Fatalf("write post-TLS EHLO: %v", err)
+			}
+			postLines := readLines(t, r)
+			if got := stripCapLines(postLines, host); !equalStrings(got, fixture.post) {
+				t.Errorf("post-TLS caps = %v, want %v", got, fixture.post)
+			}
+
+			if profile.AuthSuccess != fixture.authSuccess {
+				t.Errorf("AuthSuccess = %q, want %q", profile.AuthSuccess, fixture.authSuccess)
+			}
+			if profile.AuthFailure != fixture.authFailure {
+				t.Errorf("AuthFailure = %q, want %q", profile.AuthFailure, fixture.authFailure)
+			}
+		})
+	}
+}
+
+// stripCapLines drops writeCaps' leading "250-<host>" line and the "250-"/
+// "250 " status prefix from each remaining line, leaving just the
+// capabilities in the order ServerHandshake sent them.
+func stripCapLines(lines []string, host string) []string {
+	var out []string
+	for _, line := range lines {
+		if line == fmt.Sprintf("250-%s", host) {
+			continue
+		}
+		out = append(out, strings.TrimPrefix(strings.TrimPrefix(line, "250-"), "250 "))
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
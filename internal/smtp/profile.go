@@ -0,0 +1,202 @@
+package smtp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Profile describes the fixed strings and timing of a real-world MTA that
+// ServerHandshake impersonates, so a passive fingerprint of this fake SMTP
+// exchange matches the software it claims to be instead of betraying itself
+// through a hardcoded banner and capability list. ClientHandshake needs no
+// Profile: it only sends commands and tolerates whatever capabilities come
+// back.
+type Profile struct {
+	// Name matches the `[stealth] profile` config value.
+	Name string
+
+	// Greeting builds the 220 banner sent immediately on connect.
+	Greeting func(hostname string) string
+
+	// PreTLSCaps and PostTLSCaps are the EHLO capability lines advertised
+	// before and after STARTTLS, in the real MTA's own order, excluding the
+	// leading "250-<hostname>" line (added separately) and the AUTH line,
+	// whose position is marked with authCapSentinel.
+	PreTLSCaps  []string
+	PostTLSCaps []string
+
+	// StartTLSReady is the response line to STARTTLS.
+	StartTLSReady string
+	// AuthSuccess/AuthFailure are the response lines for AUTH outcomes.
+	AuthSuccess string
+	AuthFailure string
+
+	// CommandDelay is slept before each EHLO capability line (see writeCaps)
+	// to mimic the target MTA's own processing latency; zero disables it.
+	// The banner, the EHLO hostname line and all other replies are sent
+	// without it.
+	CommandDelay time.Duration
+}
+
+// authCapSentinel marks where the AUTH capability line belongs in a
+// Profile's PostTLSCaps; ServerHandshake replaces it with the mechanism list
+// computed from the configured Authenticator. Real MTAs only advertise AUTH
+// after STARTTLS, so PreTLSCaps never contains it.
+const authCapSentinel = "{AUTH}"
+
+func dateHeader() string {
+	return time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700")
+}
+
+// PostfixUbuntu matches Ubuntu's stock postfix package, the tunnel's
+// historical (and default) disguise.
+var PostfixUbuntu = Profile{
+	Name:     "postfix-ubuntu",
+	Greeting: func(hostname string) string { return fmt.Sprintf("220 %s ESMTP Postfix (Ubuntu)", hostname) },
+	PreTLSCaps: []string{
+		"PIPELINING",
+		"SIZE 10240000",
+		"VRFY",
+		"ETRN",
+		"STARTTLS",
+		"ENHANCEDSTATUSCODES",
+		"8BITMIME",
+		"DSN",
+		"SMTPUTF8",
+		"CHUNKING",
+	},
+	PostTLSCaps: []string{
+		"PIPELINING",
+		"SIZE 10240000",
+		"VRFY",
+		"ETRN",
+		authCapSentinel,
+		"ENHANCEDSTATUSCODES",
+		"8BITMIME",
+		"DSN",
+		"SMTPUTF8",
+		"CHUNKING",
+	},
+	StartTLSReady: "220 2.0.0 Ready to start TLS",
+	AuthSuccess:   "235 2.7.0 Authentication successful",
+	AuthFailure:   "535 5.7.8 Authentication failed",
+}
+
+// PostfixDebian matches Debian's stock postfix package: identical
+// capabilities to PostfixUbuntu, distinguished only by the banner's OS tag.
+var PostfixDebian = Profile{
+	Name:          "postfix-debian",
+	Greeting:      func(hostname string) string { return fmt.Sprintf("220 %s ESMTP Postfix (Debian/GNU)", hostname) },
+	PreTLSCaps:    PostfixUbuntu.PreTLSCaps,
+	PostTLSCaps:   PostfixUbuntu.PostTLSCaps,
+	StartTLSReady: "220 2.0.0 Ready to start TLS",
+	AuthSuccess:   "235 2.7.0 Authentication successful",
+	AuthFailure:   "535 5.7.8 Authentication failed",
+}
+
+// EximDefault matches a default Exim 4 install (e.g. Debian/Ubuntu's
+// exim4-daemon-heavy).
+var EximDefault = Profile{
+	Name: "exim",
+	Greeting: func(hostname string) string {
+		return fmt.Sprintf("220 %s ESMTP Exim 4.96 Ubuntu %s", hostname, dateHeader())
+	},
+	PreTLSCaps: []string{
+		"SIZE 52428800",
+		"PIPELINING",
+		"STARTTLS",
+		"HELP",
+	},
+	PostTLSCaps: []string{
+		"SIZE 52428800",
+		"PIPELINING",
+		authCapSentinel,
+		"HELP",
+	},
+	StartTLSReady: "220 TLS go ahead",
+	AuthSuccess:   "235 Authentication succeeded",
+	AuthFailure:   "535 Incorrect authentication data",
+}
+
+// SendmailDefault matches a default sendmail 8.15 install.
+var SendmailDefault = Profile{
+	Name: "sendmail",
+	Greeting: func(hostname string) string {
+		return fmt.Sprintf("220 %s ESMTP Sendmail 8.15.2/8.15.2; %s", hostname, dateHeader())
+	},
+	PreTLSCaps: []string{
+		"ENHANCEDSTATUSCODES",
+		"PIPELINING",
+		"8BITMIME",
+		"SIZE",
+		"DSN",
+		"ETRN",
+		"STARTTLS",
+		"DELIVERBY",
+		"HELP",
+	},
+	PostTLSCaps: []string{
+		"ENHANCEDSTATUSCODES",
+		"PIPELINING",
+		"8BITMIME",
+		"SIZE",
+		"DSN",
+		"ETRN",
+		authCapSentinel,
+		"DELIVERBY",
+		"HELP",
+	},
+	StartTLSReady: "220 2.0.0 Ready to start TLS",
+	AuthSuccess:   "235 2.0.0 OK Authenticated",
+	AuthFailure:   "535 5.7.0 authentication failed",
+}
+
+// ExchangeO365 matches the banner and capability set of Microsoft 365's
+// inbound MTA (mail.protection.outlook.com).
+var ExchangeO365 = Profile{
+	Name: "exchange-o365",
+	Greeting: func(hostname string) string {
+		return fmt.Sprintf("220 %s Microsoft ESMTP MAIL Service ready at %s", hostname, dateHeader())
+	},
+	PreTLSCaps: []string{
+		"SIZE 157286400",
+		"PIPELINING",
+		"DSN",
+		"ENHANCEDSTATUSCODES",
+		"STARTTLS",
+		"8BITMIME",
+		"BINARYMIME",
+		"CHUNKING",
+	},
+	PostTLSCaps: []string{
+		"SIZE 157286400",
+		"PIPELINING",
+		"DSN",
+		"ENHANCEDSTATUSCODES",
+		authCapSentinel,
+		"8BITMIME",
+		"BINARYMIME",
+		"CHUNKING",
+	},
+	StartTLSReady: "220 2.0.0 STARTTLS",
+	AuthSuccess:   "235 2.7.0 Authentication successful",
+	AuthFailure:   "535 5.7.3 Authentication unsuccessful",
+}
+
+// profiles maps `[stealth] profile` config values to their Profile.
+var profiles = map[string]Profile{
+	PostfixUbuntu.Name:   PostfixUbuntu,
+	PostfixDebian.Name:   PostfixDebian,
+	EximDefault.Name:     EximDefault,
+	SendmailDefault.Name: SendmailDefault,
+	ExchangeO365.Name:    ExchangeO365,
+}
+
+// LookupProfile returns the named profile, falling back to PostfixUbuntu
+// (the tunnel's previous hardcoded behavior) when name is empty or unknown.
+func LookupProfile(name string) Profile {
+	if p, ok := profiles[name]; ok {
+		return p
+	}
+	return PostfixUbuntu
+}
@@ -7,9 +7,12 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"smtptunnel/internal/metrics"
+	"smtptunnel/internal/proto"
 	"smtptunnel/internal/tunnel"
 )
 
@@ -20,22 +23,37 @@ const (
 	authPassword = 0x02
 	authNoAccept = 0xFF
 
-	cmdConnect = 0x01
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
 
 	atypIPv4   = 0x01
 	atypDomain = 0x03
 	atypIPv6   = 0x04
 
-	repSuccess         = 0x00
-	repFailure         = 0x01
-	repNotAllowed      = 0x02
-	repNetUnreachable  = 0x03
-	repHostUnreachable = 0x04
-	repConnRefused     = 0x05
-	repCmdNotSupported = 0x07
+	repSuccess          = 0x00
+	repFailure          = 0x01
+	repNotAllowed       = 0x02
+	repNetUnreachable   = 0x03
+	repHostUnreachable  = 0x04
+	repConnRefused      = 0x05
+	repCmdNotSupported  = 0x07
 	repAddrNotSupported = 0x08
 )
 
+// connectFailReply maps an OpenChannel/OpenUDPChannel rejection reason to a
+// SOCKS5 reply code: a policy rejection (proto.ConnectFailQuotaExceeded or
+// proto.ConnectFailChannelLimit) gets repNotAllowed so the client can tell a
+// quota from an unreachable host, while reason 0 (a dial failure, or no
+// tunnel connection at all) keeps the existing blanket repHostUnreachable.
+func connectFailReply(reason byte) byte {
+	switch reason {
+	case proto.ConnectFailQuotaExceeded, proto.ConnectFailChannelLimit:
+		return repNotAllowed
+	default:
+		return repHostUnreachable
+	}
+}
+
 // Server is a SOCKS5 proxy that tunnels connections.
 type Server struct {
 	ListenAddr string
@@ -150,6 +168,7 @@ func (s *Server) handleConn(conn net.Conn) {
 
 		if string(uname) != s.Username || string(passwd) != s.Password {
 			conn.Write([]byte{0x01, 0x01}) // auth failure
+			metrics.SocksAuthFailures.Inc()
 			return
 		}
 		conn.Write([]byte{0x01, 0x00}) // auth success
@@ -162,15 +181,23 @@ func (s *Server) handleConn(conn net.Conn) {
 	if _, err := io.ReadFull(conn, reqBuf); err != nil {
 		return
 	}
+	if reqBuf[0] != socks5Version {
+		return
+	}
 
-	if reqBuf[0] != socks5Version || reqBuf[1] != cmdConnect {
+	switch reqBuf[1] {
+	case cmdConnect:
+		s.handleConnect(conn, reqBuf[3])
+	case cmdUDPAssociate:
+		s.handleUDPAssociate(conn)
+	default:
 		s.sendReply(conn, repCmdNotSupported)
-		return
 	}
+}
 
+func (s *Server) handleConnect(conn net.Conn, atyp byte) {
 	// Parse address
 	var host string
-	atyp := reqBuf[3]
 
 	switch atyp {
 	case atypIPv4:
@@ -212,9 +239,9 @@ func (s *Server) handleConn(conn net.Conn) {
 	s.Logger.Printf("SOCKS5 CONNECT %s:%d", host, port)
 
 	// Open tunnel channel
-	channelID, success := s.Tunnel.OpenChannel(host, port)
+	channelID, success, reason := s.Tunnel.OpenChannel(host, port)
 	if !success {
-		s.sendReply(conn, repHostUnreachable)
+		s.sendReply(conn, connectFailReply(reason))
 		return
 	}
 
@@ -226,9 +253,11 @@ func (s *Server) handleConn(conn net.Conn) {
 	s.Tunnel.RegisterChannel(channelID, conn)
 
 	// Forward local -> tunnel
+	metrics.ActiveStreams.WithLabelValues("socks5").Inc()
 	defer func() {
 		s.Tunnel.CloseChannelRemote(channelID)
 		s.Tunnel.CloseChannel(channelID)
+		metrics.ActiveStreams.WithLabelValues("socks5").Dec()
 	}()
 
 	buf2 := make([]byte, 32768)
@@ -256,3 +285,204 @@ func (s *Server) sendReply(conn net.Conn, rep byte) {
 	// BND.ADDR = 0.0.0.0:0
 	conn.Write([]byte{socks5Version, rep, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
 }
+
+// udpAssocSession is a NAT-style mapping from a UDP ASSOCIATE client's
+// source address to the tunnel channel carrying its traffic, keyed by
+// clientAddr.String() - mirroring forward.Forwarder's UDP session tracking.
+type udpAssocSession struct {
+	channelID uint16
+	dstHost   string
+	dstPort   uint16
+}
+
+// udpAssocReplyWriter routes inbound FrameData for a UDP ASSOCIATE
+// session's channel back to the client's source address on the shared
+// relay socket, re-wrapping it in the SOCKS5 UDP request header (RFC
+// 1928 section 7) the client expects.
+type udpAssocReplyWriter struct {
+	conn    *net.UDPConn
+	addr    *net.UDPAddr
+	dstHost string
+	dstPort uint16
+}
+
+func (w *udpAssocReplyWriter) Write(p []byte) (int, error) {
+	packet := append(encodeUDPHeader(w.dstHost, w.dstPort), p...)
+	return w.conn.WriteToUDP(packet, w.addr)
+}
+
+// Close is a no-op: the relay socket is shared across all sessions on this
+// UDP ASSOCIATE and is closed when the control connection ends.
+func (w *udpAssocReplyWriter) Close() error {
+	return nil
+}
+
+// handleUDPAssociate implements SOCKS5 UDP ASSOCIATE: it opens a UDP relay
+// socket, tells the client its address in the reply, then for each
+// datagram received opens (or reuses) a tunnel UDP channel keyed by the
+// client's source address, exactly as forward.Forwarder does for plain
+// UDP forwarding. The association lives as long as the TCP control
+// connection stays open, per RFC 1928.
+func (s *Server) handleUDPAssociate(conn net.Conn) {
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		s.sendReply(conn, repFailure)
+		return
+	}
+	defer relayConn.Close()
+
+	s.sendUDPReply(conn, relayConn.LocalAddr().(*net.UDPAddr))
+
+	sessions := make(map[string]*udpAssocSession)
+	var mu sync.Mutex
+	done := make(chan struct{})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			relayConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, clientAddr, err := relayConn.ReadFromUDP(buf)
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
+				}
+				return
+			}
+
+			host, port, payload, err := decodeUDPHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			// A channel carries exactly one FrameData per datagram (see
+			// tunnel.Client.SendData), so a payload bigger than
+			// MaxPayloadSize can't be split across frames without
+			// corrupting the datagram boundary. Drop it rather than
+			// fragment, mirroring the FRAG=0-only behavior above.
+			if len(payload) > proto.MaxPayloadSize {
+				s.Logger.Printf("UDP ASSOCIATE: dropping oversized packet from %s (%d bytes)", clientAddr, len(payload))
+				continue
+			}
+
+			key := clientAddr.String()
+			mu.Lock()
+			sess, ok := sessions[key]
+			mu.Unlock()
+			if !ok {
+				channelID, success, _ := s.Tunnel.OpenUDPChannel(host, port)
+				if !success {
+					continue
+				}
+				sess = &udpAssocSession{channelID: channelID, dstHost: host, dstPort: port}
+				mu.Lock()
+				sessions[key] = sess
+				mu.Unlock()
+				s.Tunnel.RegisterChannel(channelID, &udpAssocReplyWriter{
+					conn: relayConn, addr: clientAddr, dstHost: host, dstPort: port,
+				})
+				metrics.ActiveStreams.WithLabelValues("udp").Inc()
+			}
+			s.Tunnel.SendData(sess.channelID, payload)
+		}
+	}()
+
+	// The association lasts as long as the control connection does; block
+	// here reading it (discarding any bytes, which RFC 1928 doesn't define
+	// any use for) so we notice the client closing or dropping it.
+	io.Copy(io.Discard, conn)
+	close(done)
+
+	mu.Lock()
+	for _, sess := range sessions {
+		s.Tunnel.CloseChannelRemote(sess.channelID)
+		s.Tunnel.CloseChannel(sess.channelID)
+		metrics.ActiveStreams.WithLabelValues("udp").Dec()
+	}
+	mu.Unlock()
+}
+
+func (s *Server) sendUDPReply(conn net.Conn, addr *net.UDPAddr) {
+	atyp := byte(atypIPv4)
+	ip := addr.IP.To4()
+	if ip == nil {
+		atyp = atypIPv6
+		ip = addr.IP.To16()
+	}
+
+	reply := []byte{socks5Version, repSuccess, 0x00, atyp}
+	reply = append(reply, ip...)
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, uint16(addr.Port))
+	conn.Write(append(reply, portBuf...))
+}
+
+// encodeUDPHeader builds the RFC 1928 section 7 UDP request header (RSV,
+// FRAG, ATYP, DST.ADDR, DST.PORT) that precedes every SOCKS5 UDP datagram.
+func encodeUDPHeader(host string, port uint16) []byte {
+	var atyp byte
+	var addrBytes []byte
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			atyp, addrBytes = atypIPv4, ip4
+		} else {
+			atyp, addrBytes = atypIPv6, ip.To16()
+		}
+	} else {
+		atyp = atypDomain
+		addrBytes = append([]byte{byte(len(host))}, host...)
+	}
+
+	hdr := append([]byte{0x00, 0x00, 0x00, atyp}, addrBytes...)
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, port)
+	return append(hdr, portBuf...)
+}
+
+// decodeUDPHeader parses the RFC 1928 section 7 UDP header and returns
+// the destination host, port, and the payload following it. Fragmented
+// datagrams (FRAG != 0) are rejected since this server doesn't reassemble
+// them.
+func decodeUDPHeader(data []byte) (string, uint16, []byte, error) {
+	if len(data) < 4 {
+		return "", 0, nil, fmt.Errorf("socks5: UDP header too short")
+	}
+	if data[2] != 0x00 {
+		return "", 0, nil, fmt.Errorf("socks5: fragmented UDP datagrams not supported")
+	}
+
+	atyp := data[3]
+	rest := data[4:]
+
+	var host string
+	switch atyp {
+	case atypIPv4:
+		if len(rest) < 4+2 {
+			return "", 0, nil, fmt.Errorf("socks5: truncated IPv4 UDP header")
+		}
+		host = net.IP(rest[:4]).String()
+		rest = rest[4:]
+	case atypDomain:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+			return "", 0, nil, fmt.Errorf("socks5: truncated domain UDP header")
+		}
+		l := int(rest[0])
+		host = string(rest[1 : 1+l])
+		rest = rest[1+l:]
+	case atypIPv6:
+		if len(rest) < 16+2 {
+			return "", 0, nil, fmt.Errorf("socks5: truncated IPv6 UDP header")
+		}
+		host = net.IP(rest[:16]).String()
+		rest = rest[16:]
+	default:
+		return "", 0, nil, fmt.Errorf("socks5: unsupported UDP address type 0x%02x", atyp)
+	}
+
+	port := binary.BigEndian.Uint16(rest[:2])
+	return host, port, rest[2:], nil
+}
@@ -0,0 +1,211 @@
+package stealth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ShapingConfig configures ShapedConn's per-flow traffic shaping of the
+// binary tunnel stream that follows the SMTP+STARTTLS handshake.
+type ShapingConfig struct {
+	Enabled bool
+
+	// MeanSize/StddevSize describe a log-normal distribution (in bytes)
+	// outbound writes are chunked to, calibrated to typical mail sizes.
+	MeanSize   int
+	StddevSize int
+
+	// MinDelayMs/MaxDelayMs bound a uniform inter-chunk delay.
+	MinDelayMs int
+	MaxDelayMs int
+
+	// FrameAsData wraps each chunk in a synthetic DATA/./250 framing
+	// sequence so the wire shows SMTP-shaped lines at chunk boundaries
+	// instead of one continuous binary stream.
+	FrameAsData bool
+}
+
+// dataFrameHeader and dataFrameTerminator are the literal bytes ShapedConn
+// writes around each chunk when FrameAsData is set. The chunk itself is
+// length-prefixed, so the terminator is never searched for in chunk bytes
+// (which may contain it incidentally) — only skipped as a fixed number of
+// bytes once the declared length has been consumed.
+const (
+	dataFrameHeader     = "DATA\r\n"
+	dataFrameTerminator = "\r\n.\r\n"
+)
+
+// ShapedConn wraps a net.Conn carrying the binary tunnel protocol, breaking
+// outbound writes into message-sized chunks with inter-chunk delays drawn
+// from ShapingConfig, and optionally wrapping each chunk in synthetic SMTP
+// DATA/./250 framing — decoded back to raw bytes by the peer's ShapedConn —
+// so an observer watching inter-arrival sizes and timing after "299 Binary
+// mode activated" sees something shaped like a real mail transaction instead
+// of one continuous, obviously non-SMTP binary stream.
+type ShapedConn struct {
+	net.Conn
+	cfg ShapingConfig
+	rng *mathrand.Rand
+
+	r       *bufio.Reader
+	pending []byte
+
+	writeMu sync.Mutex
+	queueID uint32
+}
+
+// NewShapedConn wraps conn for per-flow traffic shaping. If !cfg.Enabled,
+// Read/Write pass straight through to conn.
+func NewShapedConn(conn net.Conn, cfg ShapingConfig) *ShapedConn {
+	return &ShapedConn{
+		Conn: conn,
+		cfg:  cfg,
+		rng:  mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// Write chunks p per cfg and writes each chunk (optionally DATA-framed),
+// sleeping an inter-chunk delay between them.
+func (c *ShapedConn) Write(p []byte) (int, error) {
+	if !c.cfg.Enabled {
+		return c.Conn.Write(p)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		size := c.nextChunkSize()
+		if size > len(p) {
+			size = len(p)
+		}
+		chunk := p[:size]
+		if err := c.writeChunk(chunk); err != nil {
+			return written, err
+		}
+		p = p[size:]
+		written += size
+		if len(p) > 0 {
+			c.interChunkDelay()
+		}
+	}
+	return written, nil
+}
+
+// Read returns decoded chunk bytes, undoing DATA framing when cfg.FrameAsData
+// is set; otherwise it reads straight from the buffered conn.
+func (c *ShapedConn) Read(p []byte) (int, error) {
+	if !c.cfg.Enabled || !c.cfg.FrameAsData {
+		return c.r.Read(p)
+	}
+
+	for len(c.pending) == 0 {
+		chunk, err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = chunk
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *ShapedConn) nextChunkSize() int {
+	size := logNormalSize(float64(c.cfg.MeanSize), float64(c.cfg.StddevSize), c.rng)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+func (c *ShapedConn) interChunkDelay() {
+	min, max := c.cfg.MinDelayMs, c.cfg.MaxDelayMs
+	if max < min || max <= 0 {
+		return
+	}
+	d := min + c.rng.Intn(max-min+1)
+	time.Sleep(time.Duration(d) * time.Millisecond)
+}
+
+func (c *ShapedConn) writeChunk(chunk []byte) error {
+	if !c.cfg.FrameAsData {
+		_, err := c.Conn.Write(chunk)
+		return err
+	}
+
+	c.queueID++
+	var buf bytes.Buffer
+	buf.WriteString(dataFrameHeader)
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(chunk)))
+	buf.Write(lenBuf[:])
+	buf.Write(chunk)
+	buf.WriteString(dataFrameTerminator)
+	fmt.Fprintf(&buf, "250 2.0.0 Ok: queued as %08X\r\n", c.queueID)
+
+	_, err := c.Conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *ShapedConn) readChunk() ([]byte, error) {
+	header := make([]byte, len(dataFrameHeader))
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, err
+	}
+	if string(header) != dataFrameHeader {
+		return nil, fmt.Errorf("stealth: expected DATA frame header, got %q", header)
+	}
+
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(c.r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		return nil, err
+	}
+
+	term := make([]byte, len(dataFrameTerminator))
+	if _, err := io.ReadFull(c.r, term); err != nil {
+		return nil, err
+	}
+	if string(term) != dataFrameTerminator {
+		return nil, fmt.Errorf("stealth: malformed DATA frame terminator")
+	}
+
+	// Consume the synthetic "250 ... queued as <id>" status line.
+	if _, err := c.r.ReadString('\n'); err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// logNormalSize draws a chunk size from a log-normal distribution whose
+// linear mean and standard deviation are mean/stddev.
+func logNormalSize(mean, stddev float64, rng *mathrand.Rand) int {
+	if mean <= 0 {
+		return 0
+	}
+	if stddev <= 0 {
+		return int(mean)
+	}
+	variance := stddev * stddev
+	sigma2 := math.Log(1 + variance/(mean*mean))
+	mu := math.Log(mean) - sigma2/2
+	size := math.Exp(mu + math.Sqrt(sigma2)*rng.NormFloat64())
+	return int(math.Round(size))
+}
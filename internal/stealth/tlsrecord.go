@@ -0,0 +1,185 @@
+package stealth
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// TLS record types used by TLSRecordShaper. These match the real TLS 1.2
+// ContentType values so wrapped traffic is indistinguishable on the wire
+// from a genuine post-handshake TLS record stream.
+const (
+	tlsRecordChangeCipherSpec byte = 0x14
+	tlsRecordApplicationData  byte = 0x17
+	tlsRecordVersionTLS12          = 0x0303
+
+	// tlsRecordHeaderSize is type(1) + version(2) + length(2).
+	tlsRecordHeaderSize = 5
+	// tlsMaxRecordPayload is the largest payload a single TLS record may
+	// carry; larger frames are split across multiple records.
+	tlsMaxRecordPayload = 16384
+)
+
+// TLSRecordShaper wraps Shaper.PadData's output in well-formed TLS 1.2
+// records instead of sending a raw len||data||random blob. A passive
+// observer sees a record stream shaped like ordinary HTTPS traffic rather
+// than an anomalously-sized payload trailing the SMTP+STARTTLS handshake.
+type TLSRecordShaper struct {
+	*Shaper
+}
+
+// NewTLSRecordShaper wraps an existing Shaper for TLS-record-shaped framing.
+func NewTLSRecordShaper(s *Shaper) *TLSRecordShaper {
+	return &TLSRecordShaper{Shaper: s}
+}
+
+// WriteFrame pads data exactly as Shaper.PadData does, then writes it to w
+// as one or more ApplicationData records, each at most tlsMaxRecordPayload
+// bytes. The padding bytes ride inside the record payload, so to an
+// observer they're indistinguishable from ciphertext.
+func (t *TLSRecordShaper) WriteFrame(w io.Writer, data []byte) error {
+	framed := t.envelope(data)
+	for len(framed) > 0 {
+		n := len(framed)
+		if n > tlsMaxRecordPayload {
+			n = tlsMaxRecordPayload
+		}
+		if err := writeTLSRecord(w, tlsRecordApplicationData, framed[:n]); err != nil {
+			return err
+		}
+		framed = framed[n:]
+	}
+	return nil
+}
+
+// ReadFrame reassembles a frame written by WriteFrame, transparently
+// discarding any ChangeCipherSpec keepalive records injected by
+// MaybeWriteKeepalive in between.
+func (t *TLSRecordShaper) ReadFrame(r io.Reader) ([]byte, error) {
+	var buf []byte
+	total := -1
+
+	for {
+		recType, payload, err := readTLSRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		if recType != tlsRecordApplicationData {
+			continue
+		}
+
+		buf = append(buf, payload...)
+		if total < 0 && len(buf) >= 4 {
+			total = int(binary.BigEndian.Uint32(buf[:4]))
+		}
+		if total >= 0 && len(buf) >= 4+total {
+			return UnpadData(buf[4 : 4+total]), nil
+		}
+	}
+}
+
+// envelope prepends a 4-byte total length to Shaper.PadData's output so
+// ReadFrame knows when reassembly is complete even though the padded blob
+// may span several records and have keepalive records interleaved.
+func (t *TLSRecordShaper) envelope(data []byte) []byte {
+	padded := t.PadData(data)
+	out := make([]byte, 4+len(padded))
+	binary.BigEndian.PutUint32(out[:4], uint32(len(padded)))
+	copy(out[4:], padded)
+	return out
+}
+
+// MaybeWriteKeepalive occasionally injects a ChangeCipherSpec record of
+// random length, independent of any tunnel frame, so inter-arrival timing
+// on the wire resembles an ordinary browsing session rather than bursty
+// tunnel activity. It always uses ChangeCipherSpec (never ApplicationData):
+// ReadFrame can skip an unexpected ChangeCipherSpec outright, whereas an
+// injected ApplicationData record would be indistinguishable from the next
+// real frame and corrupt reassembly.
+func (t *TLSRecordShaper) MaybeWriteKeepalive(w io.Writer) error {
+	if !t.ShouldSendDummy() {
+		return nil
+	}
+	dummy := t.GenerateDummy(16, 512)
+	return writeTLSRecord(w, tlsRecordChangeCipherSpec, dummy)
+}
+
+// TLSRecordConn adapts TLSRecordShaper's whole-message WriteFrame/ReadFrame
+// to the net.Conn streaming interface, the way ShapedConn adapts Shaper for
+// the chunked-shaping mode: each Write call becomes one TLS-record-framed
+// message (plus an occasional ChangeCipherSpec keepalive), and Read
+// reassembles the next message and doles it out across as many Read calls
+// as the caller asks for.
+type TLSRecordConn struct {
+	net.Conn
+	shaper *TLSRecordShaper
+
+	pending []byte
+}
+
+// NewTLSRecordConn wraps conn so its Write/Read traffic is shaped as a
+// stream of TLS records rather than the raw binary tunnel protocol.
+func NewTLSRecordConn(conn net.Conn, shaper *Shaper) *TLSRecordConn {
+	return &TLSRecordConn{Conn: conn, shaper: NewTLSRecordShaper(shaper)}
+}
+
+// Write frames p as one message and occasionally follows it with a dummy
+// keepalive record, so inter-arrival timing doesn't betray exactly one
+// record per tunnel frame.
+func (c *TLSRecordConn) Write(p []byte) (int, error) {
+	if err := c.shaper.WriteFrame(c.Conn, p); err != nil {
+		return 0, err
+	}
+	if err := c.shaper.MaybeWriteKeepalive(c.Conn); err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+// Read returns bytes from the next reassembled message, reading a new one
+// from conn only once the previous one is fully drained.
+func (c *TLSRecordConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		frame, err := c.shaper.ReadFrame(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = frame
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func writeTLSRecord(w io.Writer, recType byte, payload []byte) error {
+	hdr := [tlsRecordHeaderSize]byte{}
+	hdr[0] = recType
+	binary.BigEndian.PutUint16(hdr[1:3], tlsRecordVersionTLS12)
+	binary.BigEndian.PutUint16(hdr[3:5], uint16(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readTLSRecord(r io.Reader) (byte, []byte, error) {
+	hdr := [tlsRecordHeaderSize]byte{}
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint16(hdr[3:5])
+	var payload []byte
+	if length > 0 {
+		payload = make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	return hdr[0], payload, nil
+}
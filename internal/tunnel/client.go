@@ -1,54 +1,155 @@
 package tunnel
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"smtptunnel/internal/config"
+	"smtptunnel/internal/crypto"
+	"smtptunnel/internal/dialer"
+	"smtptunnel/internal/metrics"
 	"smtptunnel/internal/proto"
 	"smtptunnel/internal/smtp"
+	"smtptunnel/internal/stealth"
 )
 
+// ErrReconnecting is returned by SendData and OpenReverse when the tunnel has
+// no live connection - either it never connected yet or cmd/client's
+// reconnect loop is between attempts - so callers (the SOCKS5/forward relay
+// loops) can react immediately instead of blocking on a channel or window
+// that won't drain until a new connection exists.
+var ErrReconnecting = errors.New("tunnel: reconnecting")
+
 // Client manages the tunnel connection with auto-reconnect.
 type Client struct {
 	Config    *config.Config
 	TLSConfig *tls.Config
 	Logger    *log.Logger
 
-	conn      net.Conn
-	writer    *proto.FrameWriter
+	// Upstream, if set, dials the server through a chain of proxies
+	// instead of connecting to it directly. See internal/dialer.
+	Upstream *dialer.Chain
+
+	conn net.Conn
+	// tc is non-nil only when Config.Crypto.Enabled: it holds the session
+	// keys connect derived via Handshake, layering forward-secret
+	// encryption for FrameData payloads on top of the TLS connection. Left
+	// nil, the tunnel relies on TLS alone, as before this existed.
+	tc     *crypto.TunnelCrypto
+	writer *proto.FrameWriter
+	// scheduler round-robins FrameData/FrameClose frames from every open
+	// channel onto writer, so a bulk transfer on one channel can't
+	// monopolize the connection and starve the others sharing it.
+	scheduler *frameScheduler
 	connected int32 // atomic
 
 	channels   map[uint16]*clientChannel
 	chanMu     sync.Mutex
 	nextChanID uint32
 
-	connectEvents map[uint16]chan bool
+	connectEvents map[uint16]chan connectResult
+	listenEvents  map[uint16]chan listenResult
 	eventMu       sync.Mutex
+
+	// reverseTargets maps the channel ID of a pending/registered FrameListen
+	// request to the "host:port" on the client side that every connection
+	// accepted by that reverse listener should be relayed to.
+	reverseTargets map[uint16]string
+	reverseMu      sync.Mutex
+
+	// lastPingUnixNano/lastRTTNanos record the outcome of the most recent
+	// successful RunKeepAlive ping, exposed via LastPing for status/stats
+	// output. Both 0 until the first ping completes.
+	lastPingUnixNano int64 // atomic
+	lastRTTNanos     int64 // atomic
+
+	// rekeyMu guards rekeying, which deduplicates a ShouldRekey trigger
+	// firing locally against a concurrent FrameRekeyReq from the server, so
+	// the tunnel never runs two Rekey exchanges at once. rekeyRecv feeds
+	// inbound FrameRekeyMsg payloads to whichever runRekey call is in
+	// flight; both are reset on every connect, since they belong to one
+	// connection's tc, not the Client as a whole.
+	rekeyMu   sync.Mutex
+	rekeying  bool
+	rekeyRecv chan []byte
+}
+
+// listenResult is the outcome of a FrameListen request, delivered to
+// OpenReverse via listenEvents.
+type listenResult struct {
+	ok     bool
+	port   uint16
+	errMsg string
+}
+
+// connectResult is the outcome of a FrameConnect/FrameConnectUDP request (or
+// a FramePong, which reuses the same correlation map), delivered via
+// connectEvents. reason is only meaningful when !ok, and is 0 for a dial
+// failure (the rejecting server logged the real error; see
+// proto.ConnectFailReason) or a non-zero proto.ConnectFail* code when the
+// server rejected the request outright due to a quota.
+type connectResult struct {
+	ok     bool
+	reason byte
 }
 
 type clientChannel struct {
 	id     uint16
-	conn   net.Conn
+	conn   ChannelWriter
 	closed int32 // atomic
+	window sendWindow
+
+	// lastActivity is a Unix nanosecond timestamp updated on every FrameData
+	// sent or received on this channel, read by RunIdleReaper to find
+	// channels that have sat idle longer than ChannelIdleTimeout.
+	lastActivity int64 // atomic
+
+	// ingress is this channel's bounded inbound queue: RunReceiver's single
+	// shared frame-read loop enqueues each FrameData payload here instead of
+	// writing to conn directly, so a slow local destination on one channel
+	// can only ever stall that channel's own ingressLoop goroutine, never
+	// ReadFrame itself (mirroring frameScheduler's per-channel queue for the
+	// outbound direction). done is closed by CloseChannel to stop ingressLoop
+	// and unblock anyone enqueueing into a closed channel.
+	ingress chan []byte
+	done    chan struct{}
+}
+
+// touch records activity on cc, resetting its idle timer.
+func (cc *clientChannel) touch() {
+	atomic.StoreInt64(&cc.lastActivity, time.Now().UnixNano())
+}
+
+// ChannelWriter is the sink a registered channel writes inbound data to.
+// net.Conn satisfies this, as does the UDP per-client reply writer used
+// by forward.Forwarder for NAT-style UDP sessions.
+type ChannelWriter interface {
+	Write(p []byte) (int, error)
+	Close() error
 }
 
 // NewClient creates a new tunnel client.
 func NewClient(cfg *config.Config, tlsCfg *tls.Config, logger *log.Logger) *Client {
 	return &Client{
-		Config:        cfg,
-		TLSConfig:     tlsCfg,
-		Logger:        logger,
-		channels:      make(map[uint16]*clientChannel),
-		connectEvents: make(map[uint16]chan bool),
-		nextChanID:    1,
+		Config:         cfg,
+		TLSConfig:      tlsCfg,
+		Logger:         logger,
+		channels:       make(map[uint16]*clientChannel),
+		connectEvents:  make(map[uint16]chan connectResult),
+		listenEvents:   make(map[uint16]chan listenResult),
+		reverseTargets: make(map[uint16]string),
+		nextChanID:     1,
 	}
 }
 
@@ -59,28 +160,137 @@ func (c *Client) Connected() bool {
 
 // Connect establishes the tunnel connection.
 func (c *Client) Connect() error {
+	return c.connect(false)
+}
+
+// ConnectResume establishes the tunnel connection like Connect, but if
+// resume is true it sends the BINARY RESUME hint instead of BINARY so the
+// server tears down any session it still has registered for this user (see
+// tunnel.Server.sessions) instead of rejecting the new connection outright.
+// cmd/client's reconnect loop passes true on every attempt after the first.
+func (c *Client) ConnectResume(resume bool) error {
+	return c.connect(resume)
+}
+
+func (c *Client) connect(resume bool) error {
 	c.logf("Connecting to %s", c.Config.Client.Server)
 
-	rawConn, err := net.DialTimeout("tcp", c.Config.Client.Server, 30*time.Second)
+	start := time.Now()
+
+	var rawConn net.Conn
+	var err error
+	if c.Upstream != nil {
+		rawConn, err = c.Upstream.DialTimeout("tcp", c.Config.Client.Server, 30*time.Second)
+	} else {
+		rawConn, err = net.DialTimeout("tcp", c.Config.Client.Server, 30*time.Second)
+	}
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 
 	serverHost := smtp.HostFromAddr(c.Config.Client.Server)
-	tlsConn, err := smtp.ClientHandshake(rawConn, serverHost, c.Config.Client.Username, c.Config.Client.Secret, c.TLSConfig)
+	tlsConn, err := smtp.ClientHandshake(rawConn, serverHost, c.Config.Client.Username, c.Config.Client.Secret, c.Config.Client.AuthMode, c.TLSConfig, resume)
 	if err != nil {
 		rawConn.Close()
 		return fmt.Errorf("handshake: %w", err)
 	}
 
-	c.conn = tlsConn
-	c.writer = proto.NewFrameWriter(tlsConn)
+	metrics.HandshakeSeconds.Observe(time.Since(start).Seconds())
+
+	c.conn = shapeConn(tlsConn, c.Config.Stealth)
+
+	c.tc = nil
+	c.rekeyRecv = nil
+	c.rekeyMu.Lock()
+	c.rekeying = false
+	c.rekeyMu.Unlock()
+	if c.Config.Crypto.Enabled {
+		tc, err := crypto.NewTunnelCrypto(c.Config.Client.Secret, false, c.Config.Crypto.KEM, c.Config.Crypto.RekeyBytes, c.Config.Crypto.RekeyInterval.Duration)
+		if err != nil {
+			c.conn.Close()
+			return fmt.Errorf("crypto: %w", err)
+		}
+		if err := tc.Handshake(c.conn); err != nil {
+			c.conn.Close()
+			return fmt.Errorf("crypto handshake: %w", err)
+		}
+		c.tc = tc
+		c.rekeyRecv = make(chan []byte, 2)
+	}
+
+	c.writer = proto.NewFrameWriter(c.conn)
+	c.scheduler = newFrameScheduler(c.writer)
 	atomic.StoreInt32(&c.connected, 1)
 	c.logf("Connected - binary mode active")
 
 	return nil
 }
 
+// maxChunkSize is the largest plaintext chunk SendData may hand to one
+// FrameData frame: proto.MaxPayloadSize, minus crypto.Overhead when c.tc
+// is wiring in encryption, since the ciphertext has to fit the same frame.
+func (c *Client) maxChunkSize() int {
+	if c.tc != nil {
+		return proto.MaxPayloadSize - crypto.Overhead
+	}
+	return proto.MaxPayloadSize
+}
+
+// IsPermanentError reports whether err (as returned by Connect/ConnectResume)
+// is the kind of failure that retrying with the same config can never fix -
+// bad credentials or a certificate the client will never trust - as opposed
+// to a transient network error. cmd/client's reconnect loop uses this to stop
+// retrying and exit instead of backing off forever against a config mistake.
+func IsPermanentError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var certErr x509.CertificateInvalidError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &authErr) || errors.As(err, &hostErr) {
+		return true
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "tls handshake") {
+		return true
+	}
+	// The client wraps a rejected AUTH as "auth: expected 235, got: 535 ...";
+	// the SMTP profiles vary their failure text but always answer with a 535.
+	if strings.Contains(msg, "auth:") && strings.Contains(msg, "535") {
+		return true
+	}
+	return false
+}
+
+// shapeConn layers stealth.io.Conn wrappers over conn per cfg, returning it
+// unchanged if neither mode is enabled. cfg.Enabled selects
+// stealth.TLSRecordConn, which reshapes the stream into well-formed TLS
+// records (occasionally interleaved with dummy keepalive records); the
+// result is then optionally wrapped again in stealth.ShapedConn
+// (cfg.Shaping.Enabled), which rechunks writes to mail-sized, randomly-timed
+// pieces. The two are independent knobs and compose: TLSRecordConn changes
+// what an observer sees at the TLS-record layer, ShapedConn changes inter-
+// arrival sizing and timing on top of that.
+func shapeConn(conn net.Conn, cfg config.StealthConfig) net.Conn {
+	if cfg.Enabled {
+		conn = stealth.NewTLSRecordConn(conn, stealth.NewShaper(cfg.Enabled, cfg.MinDelayMs, cfg.MaxDelayMs, cfg.PaddingSizes, cfg.DummyProbability))
+	}
+
+	shaping := cfg.Shaping
+	if !shaping.Enabled {
+		return conn
+	}
+	return stealth.NewShapedConn(conn, stealth.ShapingConfig{
+		Enabled:     shaping.Enabled,
+		MeanSize:    shaping.MeanSize,
+		StddevSize:  shaping.StddevSize,
+		MinDelayMs:  shaping.MinDelayMs,
+		MaxDelayMs:  shaping.MaxDelayMs,
+		FrameAsData: shaping.FrameAsData,
+	})
+}
+
 // RunReceiver reads frames from the server and dispatches them. Blocks until connection lost.
 func (c *Client) RunReceiver() {
 	defer func() {
@@ -106,7 +316,7 @@ func (c *Client) handleFrame(f proto.Frame) {
 		ch, ok := c.connectEvents[f.ChannelID]
 		c.eventMu.Unlock()
 		if ok {
-			ch <- true
+			ch <- connectResult{ok: true}
 		}
 
 	case proto.FrameConnectFail:
@@ -114,7 +324,7 @@ func (c *Client) handleFrame(f proto.Frame) {
 		ch, ok := c.connectEvents[f.ChannelID]
 		c.eventMu.Unlock()
 		if ok {
-			ch <- false
+			ch <- connectResult{ok: false, reason: proto.ConnectFailReason(f.Payload)}
 		}
 
 	case proto.FrameData:
@@ -122,7 +332,26 @@ func (c *Client) handleFrame(f proto.Frame) {
 		cc, ok := c.channels[f.ChannelID]
 		c.chanMu.Unlock()
 		if ok && cc != nil && atomic.LoadInt32(&cc.closed) == 0 {
-			cc.conn.Write(f.Payload)
+			cc.touch()
+			// Hand off to ingressLoop instead of writing to cc.conn here: this
+			// is the single shared frame-read loop, so a local destination
+			// that's slow to accept writes must never block here, or every
+			// other channel sharing the tunnel would stall behind it too.
+			select {
+			case cc.ingress <- f.Payload:
+			case <-cc.done:
+			}
+		}
+
+	case proto.FrameWindowAdjust:
+		delta, err := proto.ParseWindowAdjustPayload(f.Payload)
+		if err == nil {
+			c.chanMu.Lock()
+			cc, ok := c.channels[f.ChannelID]
+			c.chanMu.Unlock()
+			if ok && cc != nil {
+				cc.window.grant(delta)
+			}
 		}
 
 	case proto.FrameClose:
@@ -133,72 +362,342 @@ func (c *Client) handleFrame(f proto.Frame) {
 		ch, ok := c.connectEvents[f.ChannelID]
 		c.eventMu.Unlock()
 		if ok {
-			ch <- true
+			ch <- connectResult{ok: true}
+		}
+
+	case proto.FrameListenOK:
+		port, err := proto.ParseListenResultPayload(f.Payload)
+		c.eventMu.Lock()
+		ch, ok := c.listenEvents[f.ChannelID]
+		c.eventMu.Unlock()
+		if ok {
+			if err != nil {
+				ch <- listenResult{errMsg: err.Error()}
+			} else {
+				ch <- listenResult{ok: true, port: port}
+			}
+		}
+
+	case proto.FrameListenFail:
+		c.eventMu.Lock()
+		ch, ok := c.listenEvents[f.ChannelID]
+		c.eventMu.Unlock()
+		if ok {
+			ch <- listenResult{errMsg: string(f.Payload)}
+		}
+
+	case proto.FrameAccept:
+		c.handleReverseAccept(f)
+
+	case proto.FrameRekeyReq:
+		if c.tc != nil {
+			c.handleRekeyReq()
+		}
+
+	case proto.FrameRekeyMsg:
+		if c.tc != nil {
+			c.deliverRekeyMsg(f.Payload)
 		}
 	}
 }
 
-// OpenChannel requests a new tunnel channel to host:port.
-func (c *Client) OpenChannel(host string, port uint16) (uint16, bool) {
-	if !c.Connected() {
-		return 0, false
+// OpenChannel requests a new TCP tunnel channel to host:port. reason is only
+// meaningful when ok is false: a non-zero proto.ConnectFail* code means the
+// server rejected the request under a per-user quota rather than a dial
+// failure, letting the caller (socks5.Server) pick a more specific reply.
+func (c *Client) OpenChannel(host string, port uint16) (channelID uint16, ok bool, reason byte) {
+	return c.openChannel(proto.FrameConnect, host, port)
+}
+
+// OpenUDPChannel requests a new UDP tunnel channel to host:port. The server
+// keeps a connected UDP socket open for the lifetime of the channel instead
+// of a one-shot dial, so replies can be routed back as they arrive.
+func (c *Client) OpenUDPChannel(host string, port uint16) (channelID uint16, ok bool, reason byte) {
+	return c.openChannel(proto.FrameConnectUDP, host, port)
+}
+
+// allocChannelID mints a client-originated channel ID. IDs are masked into
+// the low half of the uint16 space (clearing bit 15) so they can never
+// collide with the server-originated reverse-forward channel IDs minted by
+// serverSession.nextReverseChannelID, which set that bit - both sides index
+// the same per-session channel map, and the wire protocol's ChannelID field
+// carries no other indication of which side picked it.
+func (c *Client) allocChannelID() uint16 {
+	id := uint16(atomic.AddUint32(&c.nextChanID, 1)-1) & 0x7fff
+	if id == 0 {
+		id = uint16(atomic.AddUint32(&c.nextChanID, 1)-1) & 0x7fff
 	}
+	return id
+}
 
-	channelID := uint16(atomic.AddUint32(&c.nextChanID, 1) - 1)
-	if channelID == 0 {
-		channelID = uint16(atomic.AddUint32(&c.nextChanID, 1) - 1)
+func (c *Client) openChannel(frameType byte, host string, port uint16) (uint16, bool, byte) {
+	if !c.Connected() {
+		return 0, false, 0
 	}
 
-	resultCh := make(chan bool, 1)
+	channelID := c.allocChannelID()
+
+	resultCh := make(chan connectResult, 1)
 	c.eventMu.Lock()
 	c.connectEvents[channelID] = resultCh
 	c.eventMu.Unlock()
 
 	payload := proto.MakeConnectPayload(host, port)
 	if err := c.writer.WriteFrame(proto.Frame{
-		Type:      proto.FrameConnect,
+		Type:      frameType,
 		ChannelID: channelID,
 		Payload:   payload,
 	}); err != nil {
 		c.eventMu.Lock()
 		delete(c.connectEvents, channelID)
 		c.eventMu.Unlock()
-		return channelID, false
+		return channelID, false, 0
 	}
 
 	select {
-	case success := <-resultCh:
+	case res := <-resultCh:
 		c.eventMu.Lock()
 		delete(c.connectEvents, channelID)
 		c.eventMu.Unlock()
-		return channelID, success
+		return channelID, res.ok, res.reason
 	case <-time.After(30 * time.Second):
 		c.eventMu.Lock()
 		delete(c.connectEvents, channelID)
 		c.eventMu.Unlock()
-		return channelID, false
+		return channelID, false, 0
+	}
+}
+
+// OpenReverse asks the server to open a listener on bindHost:bindPort and
+// tunnel every connection it accepts back to dstHost:dstPort on the client
+// side. It returns the bound port (useful when bindPort is 0, for an
+// ephemeral port) and blocks until the server confirms the listener is up
+// or rejects the request (e.g. the user isn't allowed to bind privileged
+// ports, or the address is already in use).
+func (c *Client) OpenReverse(bindHost string, bindPort uint16, dstHost string, dstPort uint16) (uint16, error) {
+	if !c.Connected() {
+		return 0, ErrReconnecting
+	}
+
+	channelID := c.allocChannelID()
+	resultCh := make(chan listenResult, 1)
+	c.eventMu.Lock()
+	c.listenEvents[channelID] = resultCh
+	c.eventMu.Unlock()
+
+	c.reverseMu.Lock()
+	c.reverseTargets[channelID] = net.JoinHostPort(dstHost, fmt.Sprintf("%d", dstPort))
+	c.reverseMu.Unlock()
+
+	cleanup := func() {
+		c.eventMu.Lock()
+		delete(c.listenEvents, channelID)
+		c.eventMu.Unlock()
+	}
+
+	payload := proto.MakeListenPayload(bindHost, bindPort, dstHost, dstPort)
+	if err := c.writer.WriteFrame(proto.Frame{Type: proto.FrameListen, ChannelID: channelID, Payload: payload}); err != nil {
+		cleanup()
+		c.reverseMu.Lock()
+		delete(c.reverseTargets, channelID)
+		c.reverseMu.Unlock()
+		return 0, err
+	}
+
+	select {
+	case res := <-resultCh:
+		cleanup()
+		if !res.ok {
+			c.reverseMu.Lock()
+			delete(c.reverseTargets, channelID)
+			c.reverseMu.Unlock()
+			return 0, fmt.Errorf("reverse listen rejected: %s", res.errMsg)
+		}
+		return res.port, nil
+	case <-time.After(30 * time.Second):
+		cleanup()
+		c.reverseMu.Lock()
+		delete(c.reverseTargets, channelID)
+		c.reverseMu.Unlock()
+		return 0, fmt.Errorf("reverse listen timeout")
+	}
+}
+
+// handleReverseAccept relays a server-accepted reverse connection
+// (identified by f.ChannelID) to the local target registered for the
+// FrameListen request named in the payload.
+func (c *Client) handleReverseAccept(f proto.Frame) {
+	listenChanID, err := proto.ParseAcceptPayload(f.Payload)
+	if err != nil {
+		c.logf("Reverse: bad ACCEPT: %v", err)
+		return
+	}
+
+	c.reverseMu.Lock()
+	target, ok := c.reverseTargets[listenChanID]
+	c.reverseMu.Unlock()
+	if !ok {
+		c.logf("Reverse: ACCEPT for unknown listener ch=%d", listenChanID)
+		c.CloseChannelRemote(f.ChannelID)
+		return
+	}
+
+	go c.relayReverse(f.ChannelID, target)
+}
+
+// relayReverse dials target and pumps data between it and the reverse
+// channel channelID, mirroring the outbound relay loops in
+// internal/forward.Forwarder.
+func (c *Client) relayReverse(channelID uint16, target string) {
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		c.logf("Reverse: dial %s failed: %v", target, err)
+		c.CloseChannelRemote(channelID)
+		return
+	}
+
+	c.RegisterChannel(channelID, conn)
+	metrics.ActiveStreams.WithLabelValues("reverse").Inc()
+	defer func() {
+		c.CloseChannelRemote(channelID)
+		c.CloseChannel(channelID)
+		metrics.ActiveStreams.WithLabelValues("reverse").Dec()
+	}()
+
+	buf := make([]byte, 32768)
+	for {
+		if !c.Connected() {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if sendErr := c.SendData(channelID, buf[:n]); sendErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return
+		}
 	}
 }
 
-// RegisterChannel adds a local connection to the channel map.
-func (c *Client) RegisterChannel(channelID uint16, conn net.Conn) {
+// RegisterChannel adds a local connection (or any ChannelWriter sink) to the
+// channel map so inbound FrameData for channelID is written to it, and
+// starts the channel's dedicated ingressLoop goroutine.
+func (c *Client) RegisterChannel(channelID uint16, conn ChannelWriter) {
+	cc := &clientChannel{
+		id:      channelID,
+		conn:    conn,
+		window:  newSendWindow(),
+		ingress: make(chan []byte, schedulerQueueLimit),
+		done:    make(chan struct{}),
+	}
+	cc.touch()
 	c.chanMu.Lock()
-	c.channels[channelID] = &clientChannel{id: channelID, conn: conn}
+	c.channels[channelID] = cc
 	c.chanMu.Unlock()
+	go c.ingressLoop(cc)
 }
 
-// SendData sends data on a channel.
+// ingressLoop drains cc.ingress to cc.conn for the lifetime of the channel,
+// so handleFrame's FrameData case - running on the single shared
+// RunReceiver loop - never blocks on a slow local destination. It credits
+// the peer's send window (FrameWindowAdjust) only after the write actually
+// happens, so a channel whose destination can't keep up stops accumulating
+// unbounded data: the peer's own window eventually runs dry and it stops
+// sending, rather than this goroutine's backlog growing forever.
+func (c *Client) ingressLoop(cc *clientChannel) {
+	for {
+		select {
+		case payload := <-cc.ingress:
+			if len(payload) == 0 {
+				continue
+			}
+			if c.tc != nil {
+				plain, err := c.tc.Decrypt(payload)
+				if err != nil {
+					c.logf("[%d] decrypt: %v", cc.id, err)
+					continue
+				}
+				payload = plain
+			}
+			cc.conn.Write(payload)
+			metrics.BytesTotal.WithLabelValues("down").Add(float64(len(payload)))
+			c.writer.WriteFrame(proto.Frame{
+				Type:      proto.FrameWindowAdjust,
+				ChannelID: cc.id,
+				Payload:   proto.MakeWindowAdjustPayload(uint32(len(payload))),
+			})
+		case <-cc.done:
+			return
+		}
+	}
+}
+
+// SendData sends data on a channel, blocking until the channel's send
+// window admits it and the scheduler's per-channel queue has room. Data is
+// split across as many FrameData frames as the window requires; each
+// reservation is sized down to maxChunkSize so a single frame never exceeds
+// the protocol's payload limit, even after crypto.TunnelCrypto.Encrypt adds
+// its overhead. Each frame's payload is copied out of data, since callers
+// (socks5.Server, forward.Forwarder) reuse their read buffer across calls
+// and the scheduler may not drain this frame before the next call
+// overwrites it.
 func (c *Client) SendData(channelID uint16, data []byte) error {
-	return c.writer.WriteFrame(proto.Frame{
-		Type:      proto.FrameData,
-		ChannelID: channelID,
-		Payload:   data,
-	})
+	if !c.Connected() {
+		return ErrReconnecting
+	}
+
+	c.chanMu.Lock()
+	cc, ok := c.channels[channelID]
+	c.chanMu.Unlock()
+	if !ok {
+		return fmt.Errorf("tunnel: unknown channel %d", channelID)
+	}
+
+	isAlive := func() bool {
+		return atomic.LoadInt32(&cc.closed) == 0
+	}
+
+	cc.touch()
+	maxChunk := c.maxChunkSize()
+	for len(data) > 0 {
+		want := len(data)
+		if want > maxChunk {
+			want = maxChunk
+		}
+		n, err := cc.window.reserve(want, isAlive)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		copy(payload, data[:n])
+		if c.tc != nil {
+			payload, err = c.tc.Encrypt(payload)
+			if err != nil {
+				return fmt.Errorf("tunnel: encrypt: %w", err)
+			}
+		}
+		c.scheduler.Enqueue(channelID, proto.Frame{
+			Type:      proto.FrameData,
+			ChannelID: channelID,
+			Payload:   payload,
+		})
+		metrics.BytesTotal.WithLabelValues("up").Add(float64(n))
+		data = data[n:]
+	}
+	return nil
 }
 
-// CloseChannelRemote tells the server to close a channel.
+// CloseChannelRemote tells the server to close a channel. Enqueued (rather
+// than written directly) so it can't overtake any FrameData for this
+// channel still sitting in the scheduler.
 func (c *Client) CloseChannelRemote(channelID uint16) {
-	c.writer.WriteFrame(proto.Frame{
+	c.scheduler.Enqueue(channelID, proto.Frame{
 		Type:      proto.FrameClose,
 		ChannelID: channelID,
 	})
@@ -215,6 +714,7 @@ func (c *Client) CloseChannel(channelID uint16) {
 
 	if ok && cc != nil {
 		atomic.StoreInt32(&cc.closed, 1)
+		close(cc.done)
 		cc.conn.Close()
 	}
 }
@@ -234,6 +734,9 @@ func (c *Client) Disconnect() {
 		c.CloseChannel(id)
 	}
 
+	if c.scheduler != nil {
+		c.scheduler.Close()
+	}
 	if c.conn != nil {
 		c.conn.Close()
 	}
@@ -243,6 +746,7 @@ func (c *Client) Disconnect() {
 func (c *Client) InjectConn(conn net.Conn) {
 	c.conn = conn
 	c.writer = proto.NewFrameWriter(conn)
+	c.scheduler = newFrameScheduler(c.writer)
 	atomic.StoreInt32(&c.connected, 1)
 }
 
@@ -252,47 +756,271 @@ func (c *Client) logf(format string, args ...interface{}) {
 	}
 }
 
-// Ping sends a PING frame and waits for PONG. Returns RTT.
+// Ping sends a PING frame and waits up to defaultKeepAliveMaxRTT for PONG.
+// Returns RTT.
 func (c *Client) Ping() (time.Duration, error) {
+	return c.sendPing(0, defaultKeepAliveMaxRTT)
+}
+
+// Default KeepAlive settings, used when the corresponding
+// config.ClientConfig field is left at its zero value.
+const (
+	defaultKeepAliveInterval  = 30 * time.Second
+	defaultKeepAliveMaxRTT    = 10 * time.Second
+	defaultKeepAliveMaxMissed = 3
+)
+
+// RunKeepAlive sends a padded PING on KeepAliveInterval for as long as the
+// tunnel stays connected, closing the connection (to trigger cmd/client's
+// reconnect supervisor) once KeepAliveMaxMissed consecutive pings either
+// time out or answer slower than KeepAliveMaxRTT. It returns once the
+// connection drops, by any cause - the caller (cmd/client's run loop) is
+// expected to start a fresh one after each reconnect, the same way it
+// restarts RunReceiver.
+func (c *Client) RunKeepAlive() {
+	interval := c.Config.Client.KeepAliveInterval.Duration
+	if interval <= 0 {
+		interval = defaultKeepAliveInterval
+	}
+	maxRTT := c.Config.Client.KeepAliveMaxRTT.Duration
+	if maxRTT <= 0 {
+		maxRTT = defaultKeepAliveMaxRTT
+	}
+	maxMissed := c.Config.Client.KeepAliveMaxMissed
+	if maxMissed <= 0 {
+		maxMissed = defaultKeepAliveMaxMissed
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for range ticker.C {
+		if !c.Connected() {
+			return
+		}
+
+		var padLen [1]byte
+		rand.Read(padLen[:])
+		// Wait well past maxRTT rather than timing out at it, so a pong
+		// that arrives late still gets measured and reported as the slow
+		// rtt it is (rtt > maxRTT below), instead of racing sendPing's own
+		// internal timeout and always turning into a flat "ping timeout".
+		rtt, err := c.sendPing(int(padLen[0]), maxRTT*2)
+		if err != nil || rtt > maxRTT {
+			missed++
+			c.logf("Keepalive: ping %d/%d missed or late (rtt=%v err=%v)", missed, maxMissed, rtt, err)
+			if missed >= maxMissed {
+				c.logf("Keepalive: peer unresponsive, closing connection")
+				c.Disconnect()
+				return
+			}
+			continue
+		}
+
+		missed = 0
+		atomic.StoreInt64(&c.lastPingUnixNano, time.Now().UnixNano())
+		atomic.StoreInt64(&c.lastRTTNanos, int64(rtt))
+	}
+}
+
+// LastPing reports when the most recent successful keepalive ping completed
+// and its RTT, for status/stats output. ok is false if no ping has
+// succeeded yet (e.g. just after connecting).
+func (c *Client) LastPing() (at time.Time, rtt time.Duration, ok bool) {
+	nano := atomic.LoadInt64(&c.lastPingUnixNano)
+	if nano == 0 {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(0, nano), time.Duration(atomic.LoadInt64(&c.lastRTTNanos)), true
+}
+
+// defaultChannelIdleTimeout is used when config.ClientConfig.ChannelIdleTimeout
+// is left at its zero value.
+const defaultChannelIdleTimeout = 5 * time.Minute
+
+// RunIdleReaper periodically closes channels that have carried no FrameData
+// in either direction for longer than ChannelIdleTimeout, notifying the
+// server with CloseChannelRemote so it frees the matching server-side
+// channel too. It blocks until the tunnel disconnects, mirroring
+// RunKeepAlive/RunReceiver - the caller is expected to start a fresh one
+// after each reconnect.
+func (c *Client) RunIdleReaper() {
+	timeout := c.Config.Client.ChannelIdleTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultChannelIdleTimeout
+	}
+
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !c.Connected() {
+			return
+		}
+
+		c.chanMu.Lock()
+		var idle []uint16
+		now := time.Now()
+		for id, cc := range c.channels {
+			last := time.Unix(0, atomic.LoadInt64(&cc.lastActivity))
+			if now.Sub(last) >= timeout {
+				idle = append(idle, id)
+			}
+		}
+		c.chanMu.Unlock()
+
+		for _, id := range idle {
+			c.logf("Idle reaper: closing channel %d (idle >= %v)", id, timeout)
+			c.CloseChannelRemote(id)
+			c.CloseChannel(id)
+		}
+	}
+}
+
+// RunRekey checks c.tc.ShouldRekey on rekeyCheckInterval for as long as the
+// tunnel stays connected, starting a coordinated Rekey with the server when
+// it trips (see startRekey). Returns immediately if crypto isn't enabled for
+// this connection (c.tc is nil), and otherwise returns once the tunnel
+// disconnects, mirroring RunKeepAlive/RunIdleReaper/RunReceiver - the caller
+// is expected to start a fresh one after each reconnect.
+func (c *Client) RunRekey() {
+	if c.tc == nil {
+		return
+	}
+
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !c.Connected() {
+			return
+		}
+		if c.tc.ShouldRekey() {
+			c.startRekey()
+		}
+	}
+}
+
+// startRekey announces this side's intent to rekey with FrameRekeyReq and
+// then runs this side's half of the exchange, unless one triggered by
+// either side is already in flight.
+func (c *Client) startRekey() {
+	if !c.beginRekey() {
+		return
+	}
+	c.writer.WriteFrame(proto.Frame{Type: proto.FrameRekeyReq})
+	c.doRekey()
+}
+
+// handleRekeyReq responds to the server's FrameRekeyReq by running this
+// side's half of the same exchange, unless one is already in flight (e.g.
+// both sides' ShouldRekey tripped at nearly the same time).
+func (c *Client) handleRekeyReq() {
+	if !c.beginRekey() {
+		return
+	}
+	c.doRekey()
+}
+
+// beginRekey claims the connection's single rekey slot, reporting false if
+// one is already in progress.
+func (c *Client) beginRekey() bool {
+	c.rekeyMu.Lock()
+	defer c.rekeyMu.Unlock()
+	if c.rekeying {
+		return false
+	}
+	c.rekeying = true
+	return true
+}
+
+// deliverRekeyMsg hands an inbound FrameRekeyMsg payload to whichever
+// runRekey call is in flight. A message arriving with no rekey in progress
+// (the server started one this side hasn't reacted to yet) still fits in
+// rekeyRecv's buffer and is picked up once doRekey's goroutine starts
+// reading.
+func (c *Client) deliverRekeyMsg(payload []byte) {
+	select {
+	case c.rekeyRecv <- payload:
+	default:
+		c.logf("Rekey: dropping FrameRekeyMsg: rekey channel full")
+	}
+}
+
+// doRekey runs the coordinated exchange in its own goroutine so RunReceiver
+// keeps delivering frames - including the FrameRekeyMsg ones this exchange
+// itself needs - while it's in progress.
+func (c *Client) doRekey() {
+	go func() {
+		defer func() {
+			c.rekeyMu.Lock()
+			c.rekeying = false
+			c.rekeyMu.Unlock()
+		}()
+
+		err := runRekey(c.tc, func(b []byte) error {
+			return c.writer.WriteFrame(proto.Frame{Type: proto.FrameRekeyMsg, Payload: b})
+		}, c.rekeyRecv)
+		if err != nil {
+			c.logf("Rekey failed: %v", err)
+		} else {
+			c.logf("Rekey complete")
+		}
+	}()
+}
+
+// pingChannelID is a reserved channel ID (outside the 0x0000-0x7fff range
+// allocChannelID hands out) used to correlate PING/PONG via the same
+// connectEvents map as CONNECT/CONNECT_OK. It does fall inside
+// nextReverseChannelID's 0x8000-0xffff range, but reverse channels are only
+// ever kept in the channels map, never in connectEvents.
+const pingChannelID = 0xFFFF
+
+// sendPing sends a PING frame padded with padLen random bytes (0 for none)
+// and waits up to timeout for the matching PONG, returning the RTT. Callers
+// should pass a timeout with headroom above the RTT they consider healthy
+// (see RunKeepAlive's use of maxRTT), or a link that's merely slow - rather
+// than actually dead - reports as a missed ping on every single try.
+func (c *Client) sendPing(padLen int, timeout time.Duration) (time.Duration, error) {
 	if !c.Connected() {
-		return 0, fmt.Errorf("not connected")
+		return 0, ErrReconnecting
 	}
 
-	// Use channelID 0xFFFF for ping
-	channelID := uint16(0xFFFF)
-	resultCh := make(chan bool, 1)
+	resultCh := make(chan connectResult, 1)
 
 	c.eventMu.Lock()
-	c.connectEvents[channelID] = resultCh
+	c.connectEvents[pingChannelID] = resultCh
 	c.eventMu.Unlock()
+	defer func() {
+		c.eventMu.Lock()
+		delete(c.connectEvents, pingChannelID)
+		c.eventMu.Unlock()
+	}()
 
-	// Embed timestamp in payload
-	payload := make([]byte, 8)
+	// The timestamp is a fixed 8 bytes at the front (unused by the server,
+	// which just echoes the whole payload back); the padding after it
+	// varies the PING/PONG frame length on the wire so an on-path observer
+	// can't fingerprint the tunnel by its constant 8-byte size.
+	payload := make([]byte, 8+padLen)
 	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	if padLen > 0 {
+		rand.Read(payload[8:])
+	}
 
 	start := time.Now()
 	if err := c.writer.WriteFrame(proto.Frame{
 		Type:      proto.FramePing,
-		ChannelID: channelID,
+		ChannelID: pingChannelID,
 		Payload:   payload,
 	}); err != nil {
-		c.eventMu.Lock()
-		delete(c.connectEvents, channelID)
-		c.eventMu.Unlock()
 		return 0, err
 	}
 
 	select {
 	case <-resultCh:
-		rtt := time.Since(start)
-		c.eventMu.Lock()
-		delete(c.connectEvents, channelID)
-		c.eventMu.Unlock()
-		return rtt, nil
-	case <-time.After(10 * time.Second):
-		c.eventMu.Lock()
-		delete(c.connectEvents, channelID)
-		c.eventMu.Unlock()
+		return time.Since(start), nil
+	case <-time.After(timeout):
 		return 0, fmt.Errorf("ping timeout")
 	}
 }
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"smtptunnel/internal/proto"
+)
+
+func newTestChannel(id uint16, conn net.Conn) *channel {
+	return &channel{
+		id:      id,
+		conn:    conn,
+		ingress: make(chan []byte, schedulerQueueLimit),
+		done:    make(chan struct{}),
+	}
+}
+
+// TestIngressLoopSlowChannelDoesNotBlockOthers reproduces the head-of-line
+// blocking scenario the per-channel ingress queue (see channel.ingress and
+// serverSession.ingressLoop) exists to prevent: one channel's destination
+// stalls mid-write, and a second channel must still make progress instead of
+// waiting behind it.
+func TestIngressLoopSlowChannelDoesNotBlockOthers(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	session := &serverSession{
+		channels: make(map[uint16]*channel),
+		writer:   proto.NewFrameWriter(io.Discard),
+		logger:   logger,
+	}
+
+	// slowPeer never reads, so writes into slowDest block forever, standing
+	// in for a destination socket whose reader has stopped draining.
+	slowDest, slowPeer := net.Pipe()
+	fastDest, fastPeer := net.Pipe()
+	defer slowDest.Close()
+	defer slowPeer.Close()
+	defer fastDest.Close()
+	defer fastPeer.Close()
+
+	slowCh := newTestChannel(1, slowDest)
+	fastCh := newTestChannel(2, fastDest)
+	session.channels[slowCh.id] = slowCh
+	session.channels[fastCh.id] = fastCh
+
+	go session.ingressLoop(slowCh)
+	go session.ingressLoop(fastCh)
+
+	session.handleData(proto.Frame{Type: proto.FrameData, ChannelID: slowCh.id, Payload: []byte("stalled")})
+
+	// Give the slow channel's ingressLoop time to dequeue the payload and
+	// block on the Write into slowPeer, so the test actually exercises the
+	// stalled-destination case rather than racing it.
+	time.Sleep(50 * time.Millisecond)
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := fastPeer.Read(buf)
+		if err != nil {
+			return
+		}
+		received <- append([]byte(nil), buf[:n]...)
+	}()
+
+	progressed := make(chan struct{})
+	go func() {
+		session.handleData(proto.Frame{Type: proto.FrameData, ChannelID: fastCh.id, Payload: []byte("progress")})
+		close(progressed)
+	}()
+
+	select {
+	case <-progressed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleData for the healthy channel blocked behind the stalled channel")
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, []byte("progress")) {
+			t.Fatalf("healthy channel's destination got %q, want %q", got, "progress")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("healthy channel's destination never received its data")
+	}
+}
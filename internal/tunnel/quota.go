@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// connectRateLimiter caps how many channels (CONNECT/CONNECT_UDP) a single
+// session may open per minute, independent of packetRateLimiter's 1-second
+// window (internal/tunnel/udprate.go), which counts already-open UDP
+// channels' datagrams rather than connection attempts.
+type connectRateLimiter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// allow reports whether another channel may be opened this minute,
+// incrementing the window's counter as a side effect. The zero value is
+// ready to use.
+func (r *connectRateLimiter) allow(limit int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.windowStart) >= time.Minute {
+		r.windowStart = now
+		r.count = 0
+	}
+	if r.count >= limit {
+		return false
+	}
+	r.count++
+	return true
+}
+
+// byteBudget enforces a per-minute byte cap by blocking the caller until
+// room frees up in the current window, rather than dropping bytes: unlike
+// the UDP packet-rate cap, channels carry reliable TCP streams that can't
+// tolerate data loss, so throttling has to mean backpressure. The zero
+// value is ready to use.
+type byteBudget struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	used        int64
+}
+
+// wait blocks until n bytes fit within limit bytes/minute, then charges them
+// against the current window. A non-positive limit is treated as unlimited
+// and returns immediately. n may exceed limit (a single FrameData payload
+// can easily be larger than a low admin-configured limit); wait then charges
+// it in limit-sized pieces across however many windows it takes, rather than
+// requiring all of n to fit in one window, which would otherwise block
+// forever. Callers must invoke wait from a channel's own goroutine
+// (ingressLoop or channelReader), never from serverSession's shared
+// frame-read loop: blocking
+// that loop would stall every other channel's frames, including PING/PONG/
+// WINDOW_ADJUST, for as long as this one channel is throttled.
+func (b *byteBudget) wait(n int, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	remainingN := int64(n)
+	for remainingN > 0 {
+		b.mu.Lock()
+		now := time.Now()
+		if now.Sub(b.windowStart) >= time.Minute {
+			b.windowStart = now
+			b.used = 0
+		}
+		avail := limit - b.used
+		if avail <= 0 {
+			remaining := time.Minute - now.Sub(b.windowStart)
+			b.mu.Unlock()
+			if remaining > 0 {
+				time.Sleep(remaining)
+			}
+			continue
+		}
+		take := remainingN
+		if take > avail {
+			take = avail
+		}
+		b.used += take
+		b.mu.Unlock()
+		remainingN -= take
+	}
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"io"
+	"time"
+
+	"smtptunnel/internal/crypto"
+)
+
+// rekeyCheckInterval is how often a session with crypto enabled checks
+// TunnelCrypto.ShouldRekey, independent of whichever of RekeyBytes/
+// RekeyInterval actually trips it.
+const rekeyCheckInterval = 10 * time.Second
+
+// rekeyTransport adapts one TunnelCrypto.Rekey exchange onto an already
+// framed tunnel connection. Rekey's handshake messages can't be written to
+// the raw connection the way the initial Handshake's are (see
+// Client.connect/Server.handleConn): ordinary FrameData and control frames
+// are already flowing over it, interleaved with whichever goroutine runs
+// Rekey. Instead each handshake message travels as the payload of its own
+// FrameRekeyMsg frame: send writes one out, recv is fed inbound ones by the
+// session's single frame-read loop (see serverSession.handleFrame/
+// Client.handleFrame), so the exchange stays correctly ordered relative to
+// everything else on the wire.
+type rekeyTransport struct {
+	send func([]byte) error
+	recv <-chan []byte
+	buf  []byte
+}
+
+func (t *rekeyTransport) Write(p []byte) (int, error) {
+	if err := t.send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *rekeyTransport) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		msg, ok := <-t.recv
+		if !ok {
+			return 0, io.EOF
+		}
+		t.buf = msg
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// runRekey drives one TunnelCrypto.Rekey exchange using send/recv as the
+// transport (see rekeyTransport). Both peers must call this at essentially
+// the same time (per TunnelCrypto.Rekey's doc comment); callers coordinate
+// that with FrameRekeyReq before calling it on either side.
+func runRekey(tc *crypto.TunnelCrypto, send func([]byte) error, recv <-chan []byte) error {
+	return tc.Rekey(&rekeyTransport{send: send, recv: recv})
+}
@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"sync"
+
+	"smtptunnel/internal/proto"
+)
+
+// schedulerQueueLimit bounds how many frames a single channel may have
+// queued for the wire before Enqueue blocks. This is separate from (and on
+// top of) the window-based flow control in window.go: the window bounds how
+// much unacknowledged data a channel may have in flight end-to-end, while
+// this bounds how much of that data may be sitting in the local scheduler
+// queue waiting for its turn on the wire.
+const schedulerQueueLimit = 64
+
+// frameScheduler multiplexes frames from many channels onto a single
+// proto.FrameWriter, round-robining channels that have data queued instead
+// of letting whichever channel's goroutine is currently writing push its
+// entire backlog before another channel gets a turn - the "ready list"
+// scheduling cloudflared's h2mux uses for the same reason: without it, one
+// channel relaying a bulk transfer can monopolize the shared TLS connection
+// and starve every other channel sharing the tunnel.
+//
+// Only frames that belong to a channel's ordered data stream (FrameData and
+// the FrameClose that ends it) go through the scheduler; low-volume control
+// frames (CONNECT/CONNECT_OK/CONNECT_FAIL/PING/PONG/WINDOW_ADJUST) are small
+// enough, and infrequent enough, to keep writing directly through the
+// shared proto.FrameWriter as before.
+type frameScheduler struct {
+	writer *proto.FrameWriter
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  map[uint16][]proto.Frame
+	ready   []uint16 // channel IDs with >=1 frame queued, FIFO turn order
+	inReady map[uint16]bool
+	closed  bool
+}
+
+// newFrameScheduler starts a scheduler writing through writer. Call Close
+// when the session ends to stop its writer goroutine.
+func newFrameScheduler(writer *proto.FrameWriter) *frameScheduler {
+	s := &frameScheduler{
+		writer:  writer,
+		queues:  make(map[uint16][]proto.Frame),
+		inReady: make(map[uint16]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Enqueue hands frame to the scheduler for channelID, blocking while that
+// channel already has schedulerQueueLimit frames queued. Safe to call from
+// the channel's own goroutine (typically the one reading from its local
+// destination socket): it only ever blocks on that channel's own backlog,
+// never on the wire itself, so a slow peer on one channel can't stall the
+// goroutine relaying a different channel.
+func (s *frameScheduler) Enqueue(channelID uint16, frame proto.Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queues[channelID]) >= schedulerQueueLimit && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return
+	}
+
+	s.queues[channelID] = append(s.queues[channelID], frame)
+	if !s.inReady[channelID] {
+		s.inReady[channelID] = true
+		s.ready = append(s.ready, channelID)
+	}
+	s.cond.Broadcast()
+}
+
+// Close stops the scheduler's writer goroutine and releases anyone blocked
+// in Enqueue. Any frames still queued are dropped.
+func (s *frameScheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// run is the scheduler's single writer goroutine. Each turn it takes one
+// frame from the head channel of the ready list and writes it; if that
+// channel still has more queued afterward, the channel goes to the back of
+// the list instead of keeping its turn, so a deep backlog on one channel
+// costs everyone else at most one frame's delay.
+func (s *frameScheduler) run() {
+	for {
+		s.mu.Lock()
+		for len(s.ready) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed && len(s.ready) == 0 {
+			s.mu.Unlock()
+			return
+		}
+
+		channelID := s.ready[0]
+		s.ready = s.ready[1:]
+
+		q := s.queues[channelID]
+		frame := q[0]
+		q = q[1:]
+		if len(q) > 0 {
+			s.queues[channelID] = q
+			s.ready = append(s.ready, channelID)
+		} else {
+			delete(s.queues, channelID)
+			s.inReady[channelID] = false
+		}
+		s.cond.Broadcast() // wake any Enqueue waiting on this channel's backlog shrinking
+		s.mu.Unlock()
+
+		if err := s.writer.WriteFrame(frame); err != nil {
+			// The underlying connection is broken, so every other channel
+			// sharing it is dead too; stop so nothing blocks in Enqueue
+			// forever waiting for a wire that will never drain again. The
+			// session's own read loop will notice the same broken
+			// connection and tear down the channels themselves.
+			s.Close()
+			return
+		}
+	}
+}
@@ -2,40 +2,117 @@
 package tunnel
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"smtptunnel/internal/config"
+	"smtptunnel/internal/crypto"
+	"smtptunnel/internal/logging"
 	"smtptunnel/internal/proto"
 	"smtptunnel/internal/smtp"
+	"smtptunnel/internal/users"
 )
 
 // Server is the main tunnel server.
 type Server struct {
-	Config    *config.Config
 	TLSConfig *tls.Config
 	Logger    *log.Logger
+
+	// mu guards Config, Auth, Sidecar, and Audit so ApplyConfig can hot-swap
+	// them (see config.Watcher) while handleConn reads a consistent snapshot
+	// for each new connection. In-flight sessions are unaffected either way,
+	// since they don't hold onto these fields past handleConn.
+	mu      sync.RWMutex
+	Config  *config.Config
+	Auth    users.Authenticator
+	Sidecar map[string]users.SidecarUser
+	Audit   *logging.Auditor
+
+	// sessMu guards sessions, the live session per username used to reject
+	// or replace a reconnecting client cleanly (see handleConn's resume
+	// handling) instead of silently running two sessions for the same user
+	// side by side.
+	sessMu   sync.Mutex
+	sessions map[string]*serverSession
 }
 
-// NewServer creates a new tunnel server.
+// NewServer creates a new tunnel server. If cfg.Server.UsersFile is set it
+// authenticates against that htpasswd-style file (with live reload);
+// otherwise it falls back to the inline [[server.users]] entries.
 func NewServer(cfg *config.Config, tlsCfg *tls.Config, logger *log.Logger) *Server {
-	return &Server{Config: cfg, TLSConfig: tlsCfg, Logger: logger}
+	srv := &Server{TLSConfig: tlsCfg, Logger: logger, sessions: make(map[string]*serverSession)}
+	srv.ApplyConfig(cfg)
+	return srv
+}
+
+// ApplyConfig swaps in cfg as the running configuration, rebuilding the
+// user table and sidecar from it. Safe to call while ListenAndServe is
+// running: a config.Watcher subscriber calls this on every hot reload, and
+// since handleConn reads Config/Auth/Sidecar fresh for each new connection
+// (rather than caching them at startup), already-open sessions are
+// unaffected and new ones immediately see the new settings.
+func (s *Server) ApplyConfig(cfg *config.Config) {
+	auth := buildAuthenticator(cfg, s.Logger)
+	sidecar, err := users.LoadSidecar(cfg.Server.SidecarFile)
+	if err != nil {
+		s.Logger.Printf("Sidecar users: %v (ignoring)", err)
+	}
+	audit := logging.NewAuditor(cfg.Server.Audit)
+
+	s.mu.Lock()
+	prevAudit := s.Audit
+	s.Config = cfg
+	s.Auth = auth
+	s.Sidecar = sidecar
+	s.Audit = audit
+	s.mu.Unlock()
+
+	// Close the outgoing Auditor (if any) only after the new one is live,
+	// so a reload never leaves a brief window with no audit sink.
+	if prevAudit != nil {
+		prevAudit.Close()
+	}
+}
+
+// snapshot returns a consistent Config/Auth/Audit triple for one connection.
+func (s *Server) snapshot() (*config.Config, users.Authenticator, *logging.Auditor) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Config, s.Auth, s.Audit
+}
+
+func buildAuthenticator(cfg *config.Config, logger *log.Logger) users.Authenticator {
+	if cfg.Server.UsersFile != "" {
+		fa, err := users.NewFileAuthenticator(cfg.Server.UsersFile, logger)
+		if err != nil {
+			logger.Printf("htpasswd users_file %q: %v, falling back to inline users", cfg.Server.UsersFile, err)
+		} else {
+			return fa
+		}
+	}
+	return users.NewMapAuthenticator(cfg.Server.Users)
 }
 
-// ListenAndServe starts listening for connections.
+// ListenAndServe starts listening for connections. The listen address is
+// fixed for the process's lifetime; other settings (users, whitelists,
+// stealth parameters) can still be hot-reloaded via ApplyConfig.
 func (s *Server) ListenAndServe() error {
-	ln, err := net.Listen("tcp", s.Config.Server.Listen)
+	cfg, _, _ := s.snapshot()
+	ln, err := net.Listen("tcp", cfg.Server.Listen)
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
-	s.Logger.Printf("Listening on %s", s.Config.Server.Listen)
-	s.Logger.Printf("Hostname: %s", s.Config.Server.Hostname)
-	s.Logger.Printf("Users loaded: %d", len(s.Config.Server.Users))
+	s.Logger.Printf("Listening on %s", cfg.Server.Listen)
+	s.Logger.Printf("Hostname: %s", cfg.Server.Hostname)
+	s.Logger.Printf("Users loaded: %d", len(cfg.Server.Users))
 
 	for {
 		conn, err := ln.Accept()
@@ -51,25 +128,48 @@ func (s *Server) handleConn(conn net.Conn) {
 	peer := conn.RemoteAddr().String()
 	s.Logger.Printf("Connection from %s", peer)
 
-	// Build user map for auth
-	users := make(map[string]string)
-	for _, u := range s.Config.Server.Users {
-		users[u.Username] = u.Secret
-	}
+	// Snapshot Config/Auth/Audit once so a config reload mid-handshake can't
+	// mix settings from two different generations within a single connection.
+	cfg, auth, audit := s.snapshot()
 
-	username, tlsConn, err := smtp.ServerHandshake(conn, s.Config.Server.Hostname, s.TLSConfig, users)
+	profile := smtp.LookupProfile(cfg.Stealth.Profile)
+	username, resume, tlsConn, err := smtp.ServerHandshake(conn, cfg.Server.Hostname, s.TLSConfig, auth, profile)
 	if err != nil {
 		s.Logger.Printf("Handshake failed from %s: %v", peer, err)
+		audit.Auth(username, peer, false, err.Error())
 		conn.Close()
 		return
 	}
 
-	// Check IP whitelist
-	user := s.Config.FindUser(username)
-	if user != nil && len(user.Whitelist) > 0 {
+	// A client reconnecting after a dropped session sends "BINARY RESUME";
+	// if one of its previous sessions is still registered (the drop hasn't
+	// been noticed yet), take over by closing it rather than running both
+	// side by side. A plain "BINARY" for a username with a session already
+	// registered is rejected cleanly instead: most likely a second client
+	// using the same credentials, not a reconnect.
+	s.sessMu.Lock()
+	prev := s.sessions[username]
+	s.sessMu.Unlock()
+	if prev != nil {
+		if !resume {
+			s.Logger.Printf("[%s] Rejecting connection from %s: session already active", username, peer)
+			audit.Auth(username, peer, false, "session already active")
+			tlsConn.Close()
+			return
+		}
+		s.Logger.Printf("[%s] Resuming: closing previous session for %s", username, peer)
+		prev.conn.Close()
+	}
+
+	// Check IP whitelist. Sidecar settings (for UsersFile-backed users) take
+	// priority over inline config entries, which have nowhere else to live
+	// once a user moves to the htpasswd file.
+	whitelist := s.userWhitelist(cfg, username)
+	if len(whitelist) > 0 {
 		clientIP, _, _ := net.SplitHostPort(peer)
-		if !isIPAllowed(clientIP, user.Whitelist) {
+		if !isIPAllowed(clientIP, whitelist) {
 			s.Logger.Printf("IP %s not in whitelist for user %s", clientIP, username)
+			audit.Auth(username, peer, false, "ip not in whitelist")
 			tlsConn.Close()
 			return
 		}
@@ -77,17 +177,183 @@ func (s *Server) handleConn(conn net.Conn) {
 
 	s.Logger.Printf("[%s] Authenticated from %s, entering binary mode", username, peer)
 
+	// Per-user UserEntry.Logging/SidecarUser.Logging gates only the
+	// per-channel connect/disconnect trail below; a successful/failed auth
+	// is always audited since it's the one event that can't yet be
+	// attributed to a user's own preference.
+	audit.Auth(username, peer, true, "")
+	logSession := s.userLogging(cfg, username)
+	allowReverse, reversePrivileged := s.userReversePerms(cfg, username)
+	maxChannels, maxConnectRate, maxBytesPerMinute := s.userQuotas(cfg, username)
+
+	idleTimeout := cfg.Server.ChannelIdleTimeout.Duration
+	if idleTimeout <= 0 {
+		idleTimeout = defaultChannelIdleTimeout
+	}
+
+	shaped := shapeConn(tlsConn, cfg.Stealth)
+
+	var tc *crypto.TunnelCrypto
+	if cfg.Crypto.Enabled {
+		if secret := s.userCryptoSecret(cfg, username); secret != "" {
+			var err error
+			tc, err = crypto.NewTunnelCrypto(secret, true, cfg.Crypto.KEM, cfg.Crypto.RekeyBytes, cfg.Crypto.RekeyInterval.Duration)
+			if err == nil {
+				err = tc.Handshake(shaped)
+			}
+			if err != nil {
+				s.Logger.Printf("[%s] crypto handshake failed: %v", username, err)
+				audit.Auth(username, peer, false, fmt.Sprintf("crypto handshake: %v", err))
+				shaped.Close()
+				return
+			}
+		} else {
+			// crypto.enabled but this user has no plaintext secret the
+			// server can fold into the exchange (e.g. a UsersFile/htpasswd
+			// entry, which only ever sees a password hash): fall back to
+			// TLS-only for this session rather than failing it outright.
+			s.Logger.Printf("[%s] crypto.enabled but no plaintext secret available; continuing without it", username)
+		}
+	}
+
+	writer := proto.NewFrameWriter(shaped)
+	var rekeyRecv chan []byte
+	if tc != nil {
+		rekeyRecv = make(chan []byte, 2)
+	}
 	session := &serverSession{
-		conn:     tlsConn,
-		username: username,
-		writer:   proto.NewFrameWriter(tlsConn),
-		channels: make(map[uint16]*channel),
-		logger:   s.Logger,
+		conn:              shaped,
+		username:          username,
+		remoteIP:          peer,
+		id:                newTunnelID(),
+		audit:             audit,
+		logAudit:          logSession,
+		allowReverse:      allowReverse,
+		reversePrivileged: reversePrivileged,
+		tc:                tc,
+		writer:            writer,
+		scheduler:         newFrameScheduler(writer),
+		channels:          make(map[uint16]*channel),
+		reverseListeners:  make(map[uint16]net.Listener),
+		logger:            s.Logger,
+		idleTimeout:       idleTimeout,
+		maxChannels:       maxChannels,
+		maxConnectRate:    maxConnectRate,
+		maxBytesPerMinute: maxBytesPerMinute,
+		rekeyRecv:         rekeyRecv,
+		stop:              make(chan struct{}),
 	}
+
+	s.sessMu.Lock()
+	s.sessions[username] = session
+	s.sessMu.Unlock()
+
 	session.run()
+
+	s.sessMu.Lock()
+	// Only remove our own entry: if a resuming reconnect already replaced
+	// it (see above), that newer session's entry must survive.
+	if s.sessions[username] == session {
+		delete(s.sessions, username)
+	}
+	s.sessMu.Unlock()
+
 	s.Logger.Printf("[%s] Session ended from %s", username, peer)
 }
 
+// newTunnelID generates a short random identifier correlating a session's
+// audit events (connect/disconnect) together, independent of the channel
+// IDs the wire protocol itself assigns.
+func newTunnelID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (s *Server) userWhitelist(cfg *config.Config, username string) []string {
+	s.mu.RLock()
+	sidecar := s.Sidecar
+	s.mu.RUnlock()
+
+	if sc, ok := sidecar[username]; ok {
+		return sc.Whitelist
+	}
+	if user := cfg.FindUser(username); user != nil {
+		return user.Whitelist
+	}
+	return nil
+}
+
+// userCryptoSecret returns the plaintext secret username authenticated with,
+// for folding into crypto.NewTunnelCrypto's key exchange, or "" if none is
+// available. Only inline [[server.users]] entries carry one: a UsersFile
+// (htpasswd) entry only ever exposes a bcrypt hash, and sidecar entries
+// don't have a secret field at all, so sessions for those users run with
+// TLS-only confidentiality even when config.CryptoConfig.Enabled is set.
+func (s *Server) userCryptoSecret(cfg *config.Config, username string) string {
+	if user := cfg.FindUser(username); user != nil {
+		return user.Secret
+	}
+	return ""
+}
+
+// userLogging reports whether the per-channel audit trail (connect/
+// disconnect events) should be emitted for username, honoring
+// config.UserEntry.Logging / users.SidecarUser.Logging the same way
+// userWhitelist honors their Whitelist fields.
+func (s *Server) userLogging(cfg *config.Config, username string) bool {
+	s.mu.RLock()
+	sidecar := s.Sidecar
+	s.mu.RUnlock()
+
+	if sc, ok := sidecar[username]; ok {
+		return sc.Logging
+	}
+	if user := cfg.FindUser(username); user != nil {
+		return user.Logging
+	}
+	return false
+}
+
+// userReversePerms reports whether username may register reverse
+// port-forward listeners (FrameListen) and, if so, whether it may bind
+// privileged (<1024) ports, honoring config.UserEntry.AllowReverse/
+// ReversePrivilegedPorts or their users.SidecarUser equivalents the same
+// way userWhitelist honors Whitelist.
+func (s *Server) userReversePerms(cfg *config.Config, username string) (allowed, privileged bool) {
+	s.mu.RLock()
+	sidecar := s.Sidecar
+	s.mu.RUnlock()
+
+	if sc, ok := sidecar[username]; ok {
+		return sc.AllowReverse, sc.ReversePrivilegedPorts
+	}
+	if user := cfg.FindUser(username); user != nil {
+		return user.AllowReverse, user.ReversePrivilegedPorts
+	}
+	return false, false
+}
+
+// userQuotas reports username's resource caps - concurrent channels,
+// channel-opens/minute, and bytes/minute - honoring config.UserEntry's (or
+// users.SidecarUser's) fields of the same name the same way userWhitelist
+// honors Whitelist. Zero means unlimited for each.
+func (s *Server) userQuotas(cfg *config.Config, username string) (maxChannels, maxConnectRate int, maxBytesPerMinute int64) {
+	s.mu.RLock()
+	sidecar := s.Sidecar
+	s.mu.RUnlock()
+
+	if sc, ok := sidecar[username]; ok {
+		return sc.MaxChannels, sc.MaxConnectRate, sc.MaxBytesPerMinute
+	}
+	if user := cfg.FindUser(username); user != nil {
+		return user.MaxChannels, user.MaxConnectRate, user.MaxBytesPerMinute
+	}
+	return 0, 0, 0
+}
+
 func isIPAllowed(ip string, whitelist []string) bool {
 	if len(whitelist) == 0 {
 		return true
@@ -116,26 +382,136 @@ func isIPAllowed(ip string, whitelist []string) bool {
 }
 
 type channel struct {
-	id     uint16
-	host   string
-	port   uint16
-	conn   net.Conn
-	closed bool
-	mu     sync.Mutex
+	id      uint16
+	host    string
+	port    uint16
+	network string
+	conn    net.Conn
+	closed  bool
+	mu      sync.Mutex
+	window  sendWindow
+
+	// rate caps inbound packets/sec for UDP channels (see handleData); it's
+	// unused (and costs nothing beyond a zero-value mutex) for TCP channels.
+	rate packetRateLimiter
+
+	// bytesIn/bytesOut count payload bytes relayed in each direction over
+	// this channel's lifetime, for the Disconnect audit event. in is
+	// client->destination, out is destination->client.
+	bytesIn  uint64
+	bytesOut uint64
+
+	// lastActivity is a Unix nanosecond timestamp updated on every FrameData
+	// sent or received on this channel, read by serverSession.reapIdleChannels
+	// to find channels that have sat idle longer than idleTimeout.
+	lastActivity int64 // atomic
+
+	// ingress is this channel's bounded inbound queue: handleData enqueues
+	// each FrameData payload here instead of writing to conn directly, so a
+	// slow destination on one channel can only ever stall that channel's own
+	// ingressLoop goroutine, never the session's single shared frame-read
+	// loop in run() (mirroring frameScheduler's per-channel queue for the
+	// outbound direction). done is closed by closeChannel to stop ingressLoop
+	// and unblock anyone enqueueing into a closed channel.
+	ingress chan []byte
+	done    chan struct{}
+}
+
+func (ch *channel) isAlive() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return !ch.closed
+}
+
+// touch records activity on ch, resetting its idle timer.
+func (ch *channel) touch() {
+	atomic.StoreInt64(&ch.lastActivity, time.Now().UnixNano())
 }
 
 type serverSession struct {
 	conn     net.Conn
 	username string
-	writer   *proto.FrameWriter
-	channels map[uint16]*channel
-	chanMu   sync.Mutex
-	logger   *log.Logger
+	remoteIP string
+	id       string
+	audit    *logging.Auditor
+	logAudit bool
+
+	// allowReverse/reversePrivileged gate FrameListen requests, mirroring
+	// config.UserEntry.AllowReverse/ReversePrivilegedPorts (or the
+	// equivalent users.SidecarUser fields) resolved once at session start.
+	allowReverse      bool
+	reversePrivileged bool
+
+	// tc is non-nil only when config.CryptoConfig.Enabled and this user has
+	// a plaintext secret the server can fold into the key exchange (see
+	// handleConn): it holds the session keys Handshake derived, layering
+	// forward-secret encryption for FrameData payloads on top of TLS.
+	tc *crypto.TunnelCrypto
+
+	writer *proto.FrameWriter
+	// scheduler round-robins FrameData/FrameClose frames from every open
+	// channel onto writer, so one channel relaying a bulk transfer can't
+	// monopolize the connection and starve the others. Control frames
+	// (CONNECT_OK, PING/PONG, WINDOW_ADJUST, ...) still go through writer
+	// directly below.
+	scheduler *frameScheduler
+	channels  map[uint16]*channel
+	chanMu    sync.Mutex
+
+	// reverseListeners holds the net.Listener opened for each FrameListen
+	// request this session registered, keyed by that request's channel ID
+	// (the same ID later embedded in each accepted connection's FrameAccept
+	// payload). Guarded by chanMu alongside channels.
+	reverseListeners map[uint16]net.Listener
+	// nextReverseChanID mints channel IDs for connections this session
+	// accepts on a reverse listener. Masked with 0x8000 set (see
+	// Client.allocChannelID) so they can never collide with the
+	// client-originated IDs arriving in CONNECT frames.
+	nextReverseChanID uint32
+
+	logger *log.Logger
+
+	// idleTimeout, maxChannels, maxConnectRate, and maxBytesPerMinute
+	// resolve config.UserEntry's (or users.SidecarUser's) fields of the same
+	// name once at session start, the same way allowReverse/reversePrivileged
+	// do above. idleTimeout always has a usable value (defaulted in
+	// handleConn); the three quota fields are zero when unlimited.
+	idleTimeout       time.Duration
+	maxChannels       int
+	maxConnectRate    int
+	maxBytesPerMinute int64
+	connectRate       connectRateLimiter
+	byteBudget        byteBudget
+
+	// rekeyMu guards rekeying, which deduplicates a ShouldRekey trigger
+	// firing locally against a concurrent FrameRekeyReq from the peer, so
+	// this session never runs two Rekey exchanges at once. rekeyRecv feeds
+	// inbound FrameRekeyMsg payloads to whichever runRekey call is in
+	// flight; both are nil when tc is (crypto disabled).
+	rekeyMu   sync.Mutex
+	rekeying  bool
+	rekeyRecv chan []byte
+
+	// stop is closed by cleanup to end idleSweepLoop.
+	stop chan struct{}
+}
+
+// nextReverseChannelID mints a server-originated channel ID for a
+// connection accepted on a reverse listener. See Client.allocChannelID for
+// why the high bit is set here and cleared there.
+func (s *serverSession) nextReverseChannelID() uint16 {
+	id := (uint16(atomic.AddUint32(&s.nextReverseChanID, 1)-1) & 0x7fff) | 0x8000
+	return id
 }
 
 func (s *serverSession) run() {
 	defer s.cleanup()
 
+	go s.idleSweepLoop()
+	if s.tc != nil {
+		go s.rekeyLoop()
+	}
+
 	for {
 		frame, err := proto.ReadFrame(s.conn)
 		if err != nil {
@@ -151,17 +527,31 @@ func (s *serverSession) run() {
 func (s *serverSession) handleFrame(f proto.Frame) {
 	switch f.Type {
 	case proto.FrameConnect:
-		s.handleConnect(f)
+		s.handleConnect(f, "tcp")
+	case proto.FrameConnectUDP:
+		s.handleConnect(f, "udp")
 	case proto.FrameData:
 		s.handleData(f)
 	case proto.FrameClose:
 		s.handleClose(f.ChannelID)
+	case proto.FrameWindowAdjust:
+		s.handleWindowAdjust(f)
+	case proto.FrameListen:
+		s.handleListen(f)
 	case proto.FramePing:
 		s.writer.WriteFrame(proto.Frame{Type: proto.FramePong, ChannelID: f.ChannelID, Payload: f.Payload})
+	case proto.FrameRekeyReq:
+		if s.tc != nil {
+			s.handleRekeyReq()
+		}
+	case proto.FrameRekeyMsg:
+		if s.tc != nil {
+			s.deliverRekeyMsg(f.Payload)
+		}
 	}
 }
 
-func (s *serverSession) handleConnect(f proto.Frame) {
+func (s *serverSession) handleConnect(f proto.Frame, network string) {
 	host, port, err := proto.ParseConnectPayload(f.Payload)
 	if err != nil {
 		s.logger.Printf("[%s] Bad CONNECT: %v", s.username, err)
@@ -169,10 +559,46 @@ func (s *serverSession) handleConnect(f proto.Frame) {
 		return
 	}
 
-	s.logger.Printf("[%s] CONNECT ch=%d -> %s:%d", s.username, f.ChannelID, host, port)
+	s.logger.Printf("[%s] CONNECT(%s) ch=%d -> %s:%d", s.username, network, f.ChannelID, host, port)
+
+	if s.maxConnectRate > 0 && !s.connectRate.allow(s.maxConnectRate) {
+		s.logger.Printf("[%s] CONNECT rejected ch=%d: connect rate exceeded", s.username, f.ChannelID)
+		s.writer.WriteFrame(proto.Frame{
+			Type:      proto.FrameConnectFail,
+			ChannelID: f.ChannelID,
+			Payload:   proto.MakeConnectFailPayload(proto.ConnectFailQuotaExceeded),
+		})
+		return
+	}
+	s.chanMu.Lock()
+	openChannels := len(s.channels)
+	s.chanMu.Unlock()
+	if s.maxChannels > 0 && openChannels >= s.maxChannels {
+		s.logger.Printf("[%s] CONNECT rejected ch=%d: channel limit reached", s.username, f.ChannelID)
+		s.writer.WriteFrame(proto.Frame{
+			Type:      proto.FrameConnectFail,
+			ChannelID: f.ChannelID,
+			Payload:   proto.MakeConnectFailPayload(proto.ConnectFailChannelLimit),
+		})
+		return
+	}
 
 	addr := fmt.Sprintf("%s:%d", host, port)
-	destConn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+
+	var destConn net.Conn
+	if network == "udp" {
+		// A connected UDP socket stays open for the channel's lifetime so
+		// replies from the destination can be routed back as they arrive,
+		// instead of the one-shot dial-per-packet model.
+		udpAddr, resolveErr := net.ResolveUDPAddr("udp", addr)
+		if resolveErr != nil {
+			err = resolveErr
+		} else {
+			destConn, err = net.DialUDP("udp", nil, udpAddr)
+		}
+	} else {
+		destConn, err = net.DialTimeout(network, addr, 30*time.Second)
+	}
 	if err != nil {
 		s.logger.Printf("[%s] Connect failed ch=%d: %v", s.username, f.ChannelID, err)
 		errMsg := []byte(err.Error())
@@ -184,11 +610,16 @@ func (s *serverSession) handleConnect(f proto.Frame) {
 	}
 
 	ch := &channel{
-		id:   f.ChannelID,
-		host: host,
-		port: port,
-		conn: destConn,
+		id:      f.ChannelID,
+		host:    host,
+		port:    port,
+		network: network,
+		conn:    destConn,
+		window:  newSendWindow(),
+		ingress: make(chan []byte, schedulerQueueLimit),
+		done:    make(chan struct{}),
 	}
+	ch.touch()
 
 	s.chanMu.Lock()
 	s.channels[f.ChannelID] = ch
@@ -196,9 +627,13 @@ func (s *serverSession) handleConnect(f proto.Frame) {
 
 	s.writer.WriteFrame(proto.Frame{Type: proto.FrameConnectOK, ChannelID: f.ChannelID})
 	s.logger.Printf("[%s] CONNECTED ch=%d", s.username, f.ChannelID)
+	if s.logAudit {
+		s.audit.Connect(s.id, s.username, s.remoteIP, network, addr)
+	}
 
 	// Read from destination and send to client
 	go s.channelReader(ch)
+	go s.ingressLoop(ch)
 }
 
 func (s *serverSession) channelReader(ch *channel) {
@@ -208,7 +643,9 @@ func (s *serverSession) channelReader(ch *channel) {
 		wasClosed := ch.closed
 		ch.mu.Unlock()
 		if !wasClosed {
-			s.writer.WriteFrame(proto.Frame{Type: proto.FrameClose, ChannelID: ch.id})
+			// Enqueued (rather than written directly) so it can't overtake
+			// any FrameData for this channel still sitting in the scheduler.
+			s.scheduler.Enqueue(ch.id, proto.Frame{Type: proto.FrameClose, ChannelID: ch.id})
 			s.closeChannel(ch.id)
 		}
 	}()
@@ -216,11 +653,12 @@ func (s *serverSession) channelReader(ch *channel) {
 	for {
 		n, err := ch.conn.Read(buf)
 		if n > 0 {
-			if writeErr := s.writer.WriteFrame(proto.Frame{
-				Type:      proto.FrameData,
-				ChannelID: ch.id,
-				Payload:   buf[:n],
-			}); writeErr != nil {
+			ch.touch()
+			atomic.AddUint64(&ch.bytesOut, uint64(n))
+			if s.maxBytesPerMinute > 0 {
+				s.byteBudget.wait(n, s.maxBytesPerMinute)
+			}
+			if sendErr := s.sendChannelData(ch, buf[:n]); sendErr != nil {
 				return
 			}
 		}
@@ -230,6 +668,150 @@ func (s *serverSession) channelReader(ch *channel) {
 	}
 }
 
+// handleListen services a FrameListen request: it validates the requesting
+// user is allowed to register reverse forwards, opens the requested
+// listener, and replies with FrameListenOK/FrameListenFail. f.ChannelID is
+// not a data channel; it's this request's correlation ID, reused later to
+// tag every connection the listener accepts (see reverseAcceptLoop) so the
+// client can look up which local target to relay it to.
+func (s *serverSession) handleListen(f proto.Frame) {
+	fail := func(msg string) {
+		s.logger.Printf("[%s] LISTEN rejected: %s", s.username, msg)
+		s.writer.WriteFrame(proto.Frame{Type: proto.FrameListenFail, ChannelID: f.ChannelID, Payload: []byte(msg)})
+	}
+
+	if !s.allowReverse {
+		fail("user not permitted to register reverse forwards")
+		return
+	}
+
+	bindHost, bindPort, dstHost, dstPort, err := proto.ParseListenPayload(f.Payload)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if bindPort != 0 && bindPort < 1024 && !s.reversePrivileged {
+		fail("user not permitted to bind privileged ports")
+		return
+	}
+
+	addr := fmt.Sprintf("%s:%d", bindHost, bindPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	s.chanMu.Lock()
+	s.reverseListeners[f.ChannelID] = ln
+	s.chanMu.Unlock()
+
+	boundPort := ln.Addr().(*net.TCPAddr).Port
+	s.logger.Printf("[%s] LISTEN ch=%d %s -> %s:%d", s.username, f.ChannelID, ln.Addr(), dstHost, dstPort)
+	s.writer.WriteFrame(proto.Frame{
+		Type:      proto.FrameListenOK,
+		ChannelID: f.ChannelID,
+		Payload:   proto.MakeListenResultPayload(uint16(boundPort)),
+	})
+
+	go s.reverseAcceptLoop(f.ChannelID, ln)
+}
+
+// reverseAcceptLoop accepts connections on ln for the lifetime of the
+// session (or until ln is closed by cleanup) and hands each one a fresh
+// server-originated channel, reusing the same channel/channelReader/
+// sendChannelData machinery outbound CONNECT channels use. The only
+// structural difference from an outbound channel is that here the server
+// already holds the connection (from Accept) instead of dialing one after
+// a CONNECT frame, so it announces the new channel with FrameAccept instead
+// of waiting for one.
+func (s *serverSession) reverseAcceptLoop(listenChanID uint16, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		ch := &channel{
+			id:      s.nextReverseChannelID(),
+			conn:    conn,
+			window:  newSendWindow(),
+			ingress: make(chan []byte, schedulerQueueLimit),
+			done:    make(chan struct{}),
+		}
+		ch.touch()
+
+		s.chanMu.Lock()
+		s.channels[ch.id] = ch
+		s.chanMu.Unlock()
+
+		s.writer.WriteFrame(proto.Frame{
+			Type:      proto.FrameAccept,
+			ChannelID: ch.id,
+			Payload:   proto.MakeAcceptPayload(listenChanID),
+		})
+		if s.logAudit {
+			s.audit.Connect(s.id, s.username, s.remoteIP, "reverse", conn.RemoteAddr().String())
+		}
+
+		go s.channelReader(ch)
+		go s.ingressLoop(ch)
+	}
+}
+
+// sendChannelData queues data to the client as one or more FrameData
+// frames, blocking on ch.window so the destination never outruns what the
+// client has acknowledged room for, and on the scheduler so one channel's
+// backlog can't grow without bound either. Each frame's payload is copied
+// out of data, which channelReader reuses across reads once this returns.
+func (s *serverSession) sendChannelData(ch *channel, data []byte) error {
+	maxChunk := proto.MaxPayloadSize
+	if s.tc != nil {
+		maxChunk -= crypto.Overhead
+	}
+	for len(data) > 0 {
+		want := len(data)
+		if want > maxChunk {
+			want = maxChunk
+		}
+		n, err := ch.window.reserve(want, ch.isAlive)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		copy(payload, data[:n])
+		if s.tc != nil {
+			payload, err = s.tc.Encrypt(payload)
+			if err != nil {
+				return fmt.Errorf("encrypt: %w", err)
+			}
+		}
+		s.scheduler.Enqueue(ch.id, proto.Frame{
+			Type:      proto.FrameData,
+			ChannelID: ch.id,
+			Payload:   payload,
+		})
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *serverSession) handleWindowAdjust(f proto.Frame) {
+	delta, err := proto.ParseWindowAdjustPayload(f.Payload)
+	if err != nil {
+		s.logger.Printf("[%s] Bad WINDOW_ADJUST ch=%d: %v", s.username, f.ChannelID, err)
+		return
+	}
+
+	s.chanMu.Lock()
+	ch, ok := s.channels[f.ChannelID]
+	s.chanMu.Unlock()
+	if !ok {
+		return
+	}
+	ch.window.grant(delta)
+}
+
 func (s *serverSession) handleData(f proto.Frame) {
 	s.chanMu.Lock()
 	ch, ok := s.channels[f.ChannelID]
@@ -246,8 +828,59 @@ func (s *serverSession) handleData(f proto.Frame) {
 		return
 	}
 
-	if _, err := ch.conn.Write(f.Payload); err != nil {
-		s.closeChannel(f.ChannelID)
+	if ch.network == "udp" && !ch.rate.allow(udpPacketRateLimit) {
+		return
+	}
+
+	select {
+	case ch.ingress <- f.Payload:
+	case <-ch.done:
+	}
+}
+
+// ingressLoop drains ch's inbound queue and writes each payload to its
+// destination, so a slow destination only ever stalls this goroutine rather
+// than the session's shared frame-read loop in run(). The byte-budget wait
+// and destination write happen here rather than in handleData for the same
+// reason: both can block, and blocking the shared read loop would stall
+// every other channel's frames (including PING/PONG/WINDOW_ADJUST) for as
+// long as this channel's quota or destination is slow. WindowAdjust credit
+// is only sent once the write actually succeeds, so the peer's send window
+// naturally stops granting this channel more data while it's backed up.
+func (s *serverSession) ingressLoop(ch *channel) {
+	for {
+		select {
+		case payload := <-ch.ingress:
+			if s.tc != nil {
+				plain, err := s.tc.Decrypt(payload)
+				if err != nil {
+					s.logger.Printf("[%s] channel %d: decrypt: %v", s.username, ch.id, err)
+					s.closeChannel(ch.id)
+					return
+				}
+				payload = plain
+			}
+
+			if s.maxBytesPerMinute > 0 {
+				s.byteBudget.wait(len(payload), s.maxBytesPerMinute)
+			}
+
+			ch.touch()
+			n, err := ch.conn.Write(payload)
+			if err != nil {
+				s.closeChannel(ch.id)
+				return
+			}
+			atomic.AddUint64(&ch.bytesIn, uint64(n))
+
+			s.writer.WriteFrame(proto.Frame{
+				Type:      proto.FrameWindowAdjust,
+				ChannelID: ch.id,
+				Payload:   proto.MakeWindowAdjustPayload(uint32(n)),
+			})
+		case <-ch.done:
+			return
+		}
 	}
 }
 
@@ -268,21 +901,162 @@ func (s *serverSession) closeChannel(channelID uint16) {
 	ch.mu.Lock()
 	ch.closed = true
 	ch.mu.Unlock()
+	close(ch.done)
 
 	ch.conn.Close()
+	if s.logAudit {
+		s.audit.Disconnect(s.id, s.username, atomic.LoadUint64(&ch.bytesIn), atomic.LoadUint64(&ch.bytesOut))
+	}
+}
+
+// idleSweepLoop periodically closes channels that have carried no FrameData
+// in either direction for longer than idleTimeout, mirroring
+// Client.RunIdleReaper on the other side of the connection. It returns once
+// cleanup closes stop.
+func (s *serverSession) idleSweepLoop() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.reapIdleChannels()
+		}
+	}
+}
+
+func (s *serverSession) reapIdleChannels() {
+	s.chanMu.Lock()
+	var idle []uint16
+	now := time.Now()
+	for id, ch := range s.channels {
+		last := time.Unix(0, atomic.LoadInt64(&ch.lastActivity))
+		if now.Sub(last) >= s.idleTimeout {
+			idle = append(idle, id)
+		}
+	}
+	s.chanMu.Unlock()
+
+	for _, id := range idle {
+		s.logger.Printf("[%s] Idle reaper: closing channel %d (idle >= %v)", s.username, id, s.idleTimeout)
+		// Enqueued (rather than written directly) so it can't overtake any
+		// FrameData for this channel still sitting in the scheduler.
+		s.scheduler.Enqueue(id, proto.Frame{Type: proto.FrameClose, ChannelID: id})
+		s.closeChannel(id)
+	}
+}
+
+// rekeyLoop periodically checks tc.ShouldRekey and, when it trips, starts a
+// coordinated Rekey with the peer (see startRekey). It exits once cleanup
+// closes stop, the same as idleSweepLoop. Only started when s.tc != nil.
+func (s *serverSession) rekeyLoop() {
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.tc.ShouldRekey() {
+				s.startRekey()
+			}
+		}
+	}
+}
+
+// startRekey announces this side's intent to rekey with FrameRekeyReq and
+// then runs this side's half of the exchange, unless one triggered by
+// either side is already in flight.
+func (s *serverSession) startRekey() {
+	if !s.beginRekey() {
+		return
+	}
+	s.writer.WriteFrame(proto.Frame{Type: proto.FrameRekeyReq})
+	s.doRekey()
+}
+
+// handleRekeyReq responds to the peer's FrameRekeyReq by running this
+// side's half of the same exchange, unless one is already in flight (e.g.
+// both sides' ShouldRekey tripped at nearly the same time).
+func (s *serverSession) handleRekeyReq() {
+	if !s.beginRekey() {
+		return
+	}
+	s.doRekey()
+}
+
+// beginRekey claims the session's single rekey slot, reporting false if one
+// is already in progress.
+func (s *serverSession) beginRekey() bool {
+	s.rekeyMu.Lock()
+	defer s.rekeyMu.Unlock()
+	if s.rekeying {
+		return false
+	}
+	s.rekeying = true
+	return true
+}
+
+// deliverRekeyMsg hands an inbound FrameRekeyMsg payload to whichever
+// runRekey call is in flight. A message arriving with no rekey in progress
+// (the peer started one this side hasn't reacted to yet) still fits in
+// rekeyRecv's buffer and is picked up once doRekey's goroutine starts
+// reading.
+func (s *serverSession) deliverRekeyMsg(payload []byte) {
+	select {
+	case s.rekeyRecv <- payload:
+	default:
+		s.logger.Printf("[%s] dropping FrameRekeyMsg: rekey channel full", s.username)
+	}
+}
+
+// doRekey runs the coordinated exchange in its own goroutine so the
+// session's shared frame-read loop keeps delivering frames - including the
+// FrameRekeyMsg ones this exchange itself needs - while it's in progress.
+func (s *serverSession) doRekey() {
+	go func() {
+		defer func() {
+			s.rekeyMu.Lock()
+			s.rekeying = false
+			s.rekeyMu.Unlock()
+		}()
+
+		err := runRekey(s.tc, func(b []byte) error {
+			return s.writer.WriteFrame(proto.Frame{Type: proto.FrameRekeyMsg, Payload: b})
+		}, s.rekeyRecv)
+		if err != nil {
+			s.logger.Printf("[%s] rekey failed: %v", s.username, err)
+		} else {
+			s.logger.Printf("[%s] rekey complete", s.username)
+		}
+	}()
 }
 
 func (s *serverSession) cleanup() {
+	close(s.stop)
+
 	s.chanMu.Lock()
 	ids := make([]uint16, 0, len(s.channels))
 	for id := range s.channels {
 		ids = append(ids, id)
 	}
+	listeners := make([]net.Listener, 0, len(s.reverseListeners))
+	for id, ln := range s.reverseListeners {
+		listeners = append(listeners, ln)
+		delete(s.reverseListeners, id)
+	}
 	s.chanMu.Unlock()
 
+	for _, ln := range listeners {
+		ln.Close()
+	}
 	for _, id := range ids {
 		s.closeChannel(id)
 	}
 
+	s.scheduler.Close()
 	s.conn.Close()
 }
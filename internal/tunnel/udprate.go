@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// udpPacketRateLimit caps how many inbound datagrams per second a single
+// UDP channel (see serverSession.handleConnect's network == "udp" case) will
+// relay to its destination, so one client can't use a single tunnel channel
+// to flood an arbitrary host.
+const udpPacketRateLimit = 500
+
+// packetRateLimiter is a fixed-window counter rather than a true token
+// bucket: UDP protocols this tunnel carries (DNS, QUIC, DTLS) burst within a
+// window as the normal case and don't need smoothing, just an upper bound.
+type packetRateLimiter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// allow reports whether another packet may be relayed this second,
+// incrementing the window's counter as a side effect. The zero value is
+// ready to use.
+func (r *packetRateLimiter) allow(limit int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.windowStart) >= time.Second {
+		r.windowStart = now
+		r.count = 0
+	}
+	if r.count >= limit {
+		return false
+	}
+	r.count++
+	return true
+}
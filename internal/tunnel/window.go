@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// initialChannelWindow is the starting per-channel send window, mirroring
+// SSH channel flow control: a sender may not have more than this many
+// bytes of unacknowledged data in flight for a channel until the peer
+// replenishes it with a FrameWindowAdjust.
+const initialChannelWindow = 256 * 1024
+
+// windowWaitPoll bounds how long reserve blocks between checks of isAlive,
+// so a channel whose peer went away doesn't wait on its window forever.
+const windowWaitPoll = 5 * time.Second
+
+// ErrWouldBlock is returned by SendData (client) or sendChannelData
+// (server) when a channel's send window is exhausted and the channel or
+// tunnel becomes unavailable before the peer replenishes it.
+var ErrWouldBlock = errors.New("tunnel: send window exhausted and channel became unavailable")
+
+// sendWindow tracks the available send window for one direction of one
+// channel and lets a writer block until bytes are available. It's embedded
+// by both clientChannel and the server-side channel type.
+type sendWindow struct {
+	available int64 // atomic
+	signal    chan struct{}
+}
+
+func newSendWindow() sendWindow {
+	return sendWindow{available: initialChannelWindow, signal: make(chan struct{}, 1)}
+}
+
+// grant adds delta bytes to the window and wakes a blocked reserve, if any.
+func (w *sendWindow) grant(delta uint32) {
+	atomic.AddInt64(&w.available, int64(delta))
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// reserve blocks until the window has at least one byte available (or
+// isAlive reports the channel is gone), then consumes and returns up to
+// want bytes.
+func (w *sendWindow) reserve(want int, isAlive func() bool) (int, error) {
+	for {
+		avail := atomic.LoadInt64(&w.available)
+		if avail > 0 {
+			n := want
+			if int64(n) > avail {
+				n = int(avail)
+			}
+			atomic.AddInt64(&w.available, -int64(n))
+			return n, nil
+		}
+		if !isAlive() {
+			return 0, ErrWouldBlock
+		}
+		select {
+		case <-w.signal:
+		case <-time.After(windowWaitPoll):
+		}
+	}
+}
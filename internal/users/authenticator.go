@@ -0,0 +1,116 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	"smtptunnel/internal/config"
+	"smtptunnel/internal/crypto"
+	"smtptunnel/internal/sasl"
+)
+
+// authTokenMaxAge is how old (in seconds) an AUTH token may be before it is
+// rejected, matching the window smtp.ServerHandshake used to enforce
+// directly via crypto.VerifyAuthToken.
+const authTokenMaxAge = 300
+
+// replayCacheMaxEntries bounds the number of distinct token MACs a
+// MapAuthenticator remembers at once, well above any realistic number of
+// logins within one authTokenMaxAge window.
+const replayCacheMaxEntries = 10000
+
+// Authenticator verifies an AUTH token produced during the SMTP handshake
+// and returns the authenticated username. smtp.ServerHandshake accepts any
+// Authenticator so inline config users and file-backed stores (see
+// htpasswd.go) can be swapped in without touching the handshake itself.
+type Authenticator interface {
+	Verify(token string) (valid bool, username string)
+}
+
+// ScramAuthenticator is implemented by Authenticators that can produce a
+// SCRAM salted credential for a username, letting smtp.ServerHandshake
+// offer SCRAM-SHA-256/SCRAM-SHA-1 instead of just a one-shot AUTH token.
+// MapAuthenticator (which holds raw secrets) implements it; FileAuthenticator
+// (bcrypt-backed) cannot, since SCRAM needs the raw secret to derive a
+// salted verifier, not a one-way password hash.
+type ScramAuthenticator interface {
+	ScramCredential(h sasl.ScramHash, username string) (sasl.Credential, bool)
+}
+
+// ExternalAuthenticator is implemented by Authenticators that can confirm a
+// username is known without a password, letting smtp.ServerHandshake offer
+// AUTH EXTERNAL, which authenticates by TLS client certificate identity
+// alone.
+type ExternalAuthenticator interface {
+	VerifyExternal(username string) bool
+}
+
+// FingerprintAuthenticator is implemented by Authenticators that can map a
+// verified mTLS peer certificate's SHA-256 fingerprint directly to a
+// username, for users provisioned with a client certificate (see
+// internal/pki and config.UserEntry.ClientCertFingerprint) instead of a
+// shared secret. Unlike ExternalAuthenticator, which trusts whatever
+// CommonName the certificate happens to carry, this binds the session to
+// the exact leaf certificate the server issued for that user.
+type FingerprintAuthenticator interface {
+	VerifyFingerprint(fingerprint string) (valid bool, username string)
+}
+
+// MapAuthenticator authenticates against an in-memory username->secret map,
+// the behavior inline `[[server.users]]` config entries have always had. It
+// also indexes each user's optional client certificate fingerprint so
+// VerifyFingerprint can resolve mTLS sessions straight to a username.
+type MapAuthenticator struct {
+	secrets      map[string]string
+	fingerprints map[string]string // lowercase hex SHA-256 -> username
+	replay       *crypto.ReplayCache
+}
+
+// Verify implements Authenticator using the existing HMAC auth token
+// scheme, rejecting a token whose MAC has already been presented within
+// authTokenMaxAge.
+func (m MapAuthenticator) Verify(token string) (bool, string) {
+	return crypto.VerifyAuthToken(token, m.secrets, authTokenMaxAge, m.replay)
+}
+
+// ScramCredential implements ScramAuthenticator by deriving the credential
+// on the fly from the raw secret held in the map.
+func (m MapAuthenticator) ScramCredential(h sasl.ScramHash, username string) (sasl.Credential, bool) {
+	secret, ok := m.secrets[username]
+	if !ok {
+		return sasl.Credential{}, false
+	}
+	return sasl.DeriveCredential(h, username, secret), true
+}
+
+// VerifyExternal implements ExternalAuthenticator by checking that username
+// is a known user; the password itself was already proven out-of-band by
+// the TLS client certificate.
+func (m MapAuthenticator) VerifyExternal(username string) bool {
+	_, ok := m.secrets[username]
+	return ok
+}
+
+// VerifyFingerprint implements FingerprintAuthenticator by looking up the
+// user whose config.UserEntry.ClientCertFingerprint matches the verified
+// peer certificate.
+func (m MapAuthenticator) VerifyFingerprint(fingerprint string) (bool, string) {
+	username, ok := m.fingerprints[strings.ToLower(fingerprint)]
+	return ok, username
+}
+
+// NewMapAuthenticator builds a MapAuthenticator from inline config users.
+func NewMapAuthenticator(entries []config.UserEntry) MapAuthenticator {
+	m := MapAuthenticator{
+		secrets:      make(map[string]string, len(entries)),
+		fingerprints: make(map[string]string),
+		replay:       crypto.NewReplayCache(authTokenMaxAge*time.Second, replayCacheMaxEntries),
+	}
+	for _, e := range entries {
+		m.secrets[e.Username] = e.Secret
+		if e.ClientCertFingerprint != "" {
+			m.fingerprints[strings.ToLower(e.ClientCertFingerprint)] = e.Username
+		}
+	}
+	return m
+}
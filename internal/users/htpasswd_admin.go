@@ -0,0 +1,132 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAdd adds or replaces username's bcrypt-hashed entry in the
+// htpasswd file at path, creating the file if it doesn't exist.
+func HtpasswdAdd(path, username, password string) error {
+	return withHtpasswdLock(path, func(lines []string) ([]string, error) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("hash password: %w", err)
+		}
+		entry := fmt.Sprintf("%s:%s", username, hash)
+		return upsertHtpasswdEntry(lines, username, entry), nil
+	})
+}
+
+// HtpasswdSetPassword updates username's password, failing if the user does
+// not already have an entry in path.
+func HtpasswdSetPassword(path, username, password string) error {
+	return withHtpasswdLock(path, func(lines []string) ([]string, error) {
+		if !hasHtpasswdEntry(lines, username) {
+			return nil, fmt.Errorf("user %q not found in %s", username, path)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("hash password: %w", err)
+		}
+		entry := fmt.Sprintf("%s:%s", username, hash)
+		return upsertHtpasswdEntry(lines, username, entry), nil
+	})
+}
+
+// HtpasswdDel removes username's entry from the htpasswd file at path.
+func HtpasswdDel(path, username string) error {
+	return withHtpasswdLock(path, func(lines []string) ([]string, error) {
+		out := make([]string, 0, len(lines))
+		found := false
+		for _, line := range lines {
+			if htpasswdEntryUsername(line) == username {
+				found = true
+				continue
+			}
+			out = append(out, line)
+		}
+		if !found {
+			return nil, fmt.Errorf("user %q not found in %s", username, path)
+		}
+		return out, nil
+	})
+}
+
+func htpasswdEntryUsername(line string) string {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return ""
+	}
+	return line[:idx]
+}
+
+func hasHtpasswdEntry(lines []string, username string) bool {
+	for _, line := range lines {
+		if htpasswdEntryUsername(line) == username {
+			return true
+		}
+	}
+	return false
+}
+
+func upsertHtpasswdEntry(lines []string, username, entry string) []string {
+	for i, line := range lines {
+		if htpasswdEntryUsername(line) == username {
+			lines[i] = entry
+			return lines
+		}
+	}
+	return append(lines, entry)
+}
+
+// withHtpasswdLock reads path under an exclusive advisory lock (see
+// lockFile/unlockFile), lets fn produce the rewritten line set, and writes
+// the result back in place. The lock keeps concurrent `htpasswd` subcommand
+// invocations from clobbering each other.
+func withHtpasswdLock(path string, fn func(lines []string) ([]string, error)) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("lock %s: %w", path, err)
+	}
+	defer unlockFile(f)
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	newLines, err := fn(lines)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("truncate %s: %w", path, err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range newLines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
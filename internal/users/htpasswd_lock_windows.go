@@ -0,0 +1,29 @@
+//go:build windows
+
+package users
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFileRange covers the whole file regardless of its actual size:
+// LockFileEx/UnlockFileEx lock a byte range rather than the file as a whole,
+// and the htpasswd file can grow between the lock and unlock calls.
+const lockFileRangeLow, lockFileRangeHigh = ^uint32(0), ^uint32(0)
+
+// lockFile takes an exclusive advisory lock on f, blocking until it's held.
+// syscall.Flock doesn't exist on Windows, so this uses the LockFileEx API
+// instead, which every other process opening the same htpasswd file under
+// this package also has to go through to be seen.
+func lockFile(f *os.File) error {
+	overlapped := new(windows.Overlapped)
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, lockFileRangeLow, lockFileRangeHigh, overlapped)
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	overlapped := new(windows.Overlapped)
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, lockFileRangeLow, lockFileRangeHigh, overlapped)
+}
@@ -0,0 +1,44 @@
+package users
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SidecarUser holds the per-user settings that have nowhere to live once a
+// server's users come from UsersFile rather than inline `[[server.users]]`
+// entries: IP whitelist, whether to log the session, reverse port-forward
+// permissions, and resource quotas.
+type SidecarUser struct {
+	Whitelist              []string `toml:"whitelist"`
+	Logging                bool     `toml:"logging"`
+	AllowReverse           bool     `toml:"allow_reverse"`
+	ReversePrivilegedPorts bool     `toml:"reverse_privileged_ports"`
+
+	// MaxChannels, MaxConnectRate, and MaxBytesPerMinute mirror
+	// config.UserEntry's fields of the same name.
+	MaxChannels       int   `toml:"max_channels"`
+	MaxConnectRate    int   `toml:"max_connect_rate"`
+	MaxBytesPerMinute int64 `toml:"max_bytes_per_minute"`
+}
+
+// LoadSidecar reads a TOML file of `[username]` tables into a map keyed by
+// username. An empty path is not an error; it simply yields no entries.
+func LoadSidecar(path string) (map[string]SidecarUser, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sidecar %s: %w", path, err)
+	}
+
+	var entries map[string]SidecarUser
+	if err := toml.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse sidecar %s: %w", path, err)
+	}
+	return entries, nil
+}
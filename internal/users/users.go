@@ -13,7 +13,7 @@ import (
 )
 
 // AddUser adds a new user to the config file.
-func AddUser(configPath, username, secret string, whitelist []string, logging bool) error {
+func AddUser(configPath, username, secret string, whitelist []string, logging, allowReverse, reversePrivileged bool) error {
 	cfg, err := config.Load(configPath)
 	if err != nil {
 		// If file doesn't exist, create with defaults
@@ -47,16 +47,37 @@ func AddUser(configPath, username, secret string, whitelist []string, logging bo
 
 	// Add user
 	cfg.Server.Users = append(cfg.Server.Users, config.UserEntry{
-		Username:  username,
-		Secret:    secret,
-		Whitelist: whitelist,
-		Logging:   logging,
+		Username:               username,
+		Secret:                 secret,
+		Whitelist:              whitelist,
+		Logging:                logging,
+		AllowReverse:           allowReverse,
+		ReversePrivilegedPorts: reversePrivileged,
 	})
 
 	// Write back
 	return writeConfig(configPath, cfg)
 }
 
+// SetClientCertFingerprint records username's mTLS client certificate
+// fingerprint in the config file, so a session presenting that certificate
+// can authenticate via AUTH EXTERNAL, with no secret (see internal/pki).
+func SetClientCertFingerprint(configPath, username, fingerprint string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	for i := range cfg.Server.Users {
+		if cfg.Server.Users[i].Username == username {
+			cfg.Server.Users[i].ClientCertFingerprint = fingerprint
+			return writeConfig(configPath, cfg)
+		}
+	}
+
+	return fmt.Errorf("user %q not found", username)
+}
+
 // DelUser removes a user from the config file.
 func DelUser(configPath, username string) error {
 	cfg, err := config.Load(configPath)